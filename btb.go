@@ -0,0 +1,57 @@
+package mips
+
+// BranchTargetBuffer caches the targets of taken branches by their address,
+// so that fetch can be redirected in IF1 before the branch is decoded. It
+// is set associative with least recently used replacement.
+type BranchTargetBuffer struct {
+	Hits   int
+	Misses int
+	sets   [][]btbEntry // most recently used first
+	ways   int
+}
+
+type btbEntry struct {
+	pc     int
+	target Word
+}
+
+// NewBranchTargetBuffer returns a BTB of entries entries in sets of ways
+func NewBranchTargetBuffer(entries, ways int) *BranchTargetBuffer {
+	return &BranchTargetBuffer{sets: make([][]btbEntry, entries/ways), ways: ways}
+}
+
+func (b *BranchTargetBuffer) set(pc int) int {
+	return pc % len(b.sets)
+}
+
+// Lookup returns the target cached for the branch at pc
+func (b *BranchTargetBuffer) Lookup(pc int) (Word, bool) {
+	set := b.sets[b.set(pc)]
+	for n, e := range set {
+		if e.pc == pc {
+			copy(set[1:n+1], set[:n])
+			set[0] = e
+			b.Hits++
+			return e.target, true
+		}
+	}
+	b.Misses++
+	return 0, false
+}
+
+// Insert caches the target of a taken branch, evicting the least recently
+// used entry of a full set
+func (b *BranchTargetBuffer) Insert(pc int, target Word) {
+	n := b.set(pc)
+	set := b.sets[n]
+	for k, e := range set {
+		if e.pc == pc {
+			set = append(set[:k], set[k+1:]...)
+			break
+		}
+	}
+	if len(set) == b.ways {
+		set = set[:b.ways-1]
+	}
+	b.sets[n] = append([]btbEntry{{pc, target}}, set...)
+}
@@ -20,12 +20,14 @@ const (
 	modeNoForwarding = iota
 	modePredictTaken
 	modePredictNotTaken
+	modePredictTwoBit
 )
 
 var modeNames = map[int]string{
 	modeNoForwarding:    "No Forwarding/Bypassing",
 	modePredictTaken:    "Predict Branches Taken",
 	modePredictNotTaken: "Predict Branches Not Taken",
+	modePredictTwoBit:   "Predict Branches with 2-bit Counters",
 }
 
 type simulator struct {
@@ -67,6 +69,7 @@ func (s *simulator) collectInput() (err error) {
 		modeNoForwarding,
 		modePredictTaken,
 		modePredictNotTaken,
+		modePredictTwoBit,
 	} {
 		fmt.Fprintf(s.o, "%d: %s\n", mode, modeNames[mode])
 	}
@@ -120,24 +123,24 @@ func (s *simulator) run() error {
 		return err
 	}
 
-	cpu, err := mips.ParseCPUString(string(input))
-	if err != nil {
-		return err
-	}
-
+	var opts []mips.Option
 	switch s.simulatorMode {
 	case modeNoForwarding:
-		cpu.ForwardingEnabled = false
-		cpu.BranchMode = mips.BranchPolicyFlush
+		opts = append(opts, mips.WithForwarding(false), mips.WithBranchPolicy(mips.BranchPolicyFlush))
 	case modePredictTaken:
-		cpu.ForwardingEnabled = true
-		cpu.BranchMode = mips.BranchPolicyPredictTaken
+		opts = append(opts, mips.WithForwarding(true), mips.WithBranchPolicy(mips.BranchPolicyPredictTaken))
 	case modePredictNotTaken:
-		cpu.ForwardingEnabled = true
-		cpu.BranchMode = mips.BranchPolicyPredictTaken
+		opts = append(opts, mips.WithForwarding(true), mips.WithBranchPolicy(mips.BranchPolicyPredictNotTaken))
+	case modePredictTwoBit:
+		opts = append(opts, mips.WithForwarding(true), mips.WithBranchPredictor(mips.NewTwoBitPredictor(64)))
+	}
+
+	cpu, err := mips.ParseCPUString(string(input), opts...)
+	if err != nil {
+		return err
 	}
 
-	fmt.Fprintln(s.o, "\nRunning Simulation.\n")
+	fmt.Fprint(s.o, "\nRunning Simulation.\n\n")
 	if err := cpu.Run(10000); err != nil {
 		fmt.Fprintln(os.Stderr, "Error running simulation:", err)
 		return err
@@ -151,6 +154,7 @@ func (s *simulator) run() error {
 		return err
 	}
 	fmt.Fprintln(s.o, "Wrote register contents to", s.registerFile)
+	fmt.Fprint(s.o, "\n", cpu.Stats())
 	return nil
 }
 
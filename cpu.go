@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 )
 
 // Branch prediction modes
@@ -14,8 +16,38 @@ const (
 	BranchPolicyFlush = iota // no prediction, flush pipeline
 	BranchPolicyPredictTaken
 	BranchPolicyPredictNotTaken
+	BranchPolicyPredictDynamic // ask the CPU's BranchPredictor
 )
 
+// Forwarding paths, the stage a value is forwarded from and the stage that
+// reads it. Operands are read in ID, so EX→EX and MEM→EX are modelled as the
+// EX and memory latches feeding ID in the same cycle.
+type ForwardingPath int
+
+const (
+	ForwardEXtoEX   ForwardingPath = 1 << iota // from the EX output latch
+	ForwardMEMtoEX                             // from the latches between memory stages
+	ForwardMEM3toID                            // from the output latch of the last memory stage
+	ForwardWBtoID                              // split-cycle register file, written before it is read
+
+	ForwardRegisterFile ForwardingPath = ForwardWBtoID // no forwarding, the register file is still split-cycle
+	ForwardAll          ForwardingPath = ForwardEXtoEX | ForwardMEMtoEX | ForwardMEM3toID | ForwardWBtoID
+)
+
+func (f ForwardingPath) String() string {
+	names := []string{"EX->EX", "MEM->EX", "MEM3->ID", "WB->ID"}
+	result := ""
+	for n, name := range names {
+		if f&(1<<uint(n)) != 0 {
+			if result != "" {
+				result += ","
+			}
+			result += name
+		}
+	}
+	return result
+}
+
 type InstructionCache []Instruction
 
 var (
@@ -26,7 +58,10 @@ var (
 type CPU struct {
 	Registers          *Registers
 	BranchMode         BranchPolicy
-	ForwardingEnabled  bool
+	Predictor          BranchPredictor     // under BranchPolicyPredictDynamic
+	BTB                *BranchTargetBuffer // if set, branches are predicted in IF1
+	RAS                *ReturnAddressStack // if set, predicts the targets of returns
+	Forwarding         ForwardingPath      // enabled forwarding paths
 	Cycle              int
 	Ram                Memory
 	InstructionCache   InstructionCache
@@ -34,31 +69,80 @@ type CPU struct {
 	Instructions       []*ExecutedInstruction
 	Labels             map[Label]int // label to Code index mapping
 	Pipeline           Pipeline
+	Units              []*FunctionalUnit // functional units EX dispatches to
+	Trace              io.Writer         // if set, receives the state after every cycle
+	DelaySlots         int               // instructions after a branch executed regardless
+	delaySlots         int               // still to be fetched before delayedJump
+	delayedJump        int
+	Engine             Engine               // if set, executes the program instead of the pipeline
+	Renaming           *RenameTable         // if set, ID renames R1-R31 onto physical registers
+	operands           map[Register]Word    // operand values read by decode or supplied by the engine
+	writing            *ExecutedInstruction // the instruction in WB, whose results go to its physical registers
 }
 
-func NewCPU() *CPU {
+// NewCPU creates a CPU with the nine stage pipeline, flushing on branches
+// and without forwarding, unless configured otherwise by opts
+func NewCPU(opts ...Option) (*CPU, error) {
+	c := &config{
+		stages:       NineStagePipeline(),
+		branchPolicy: BranchPolicyFlush,
+		forwarding:   ForwardRegisterFile,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
 	cpu := &CPU{
 		InstructionCache: make([]Instruction, 0),
 		Labels:           make(map[Label]int),
 		Registers:        NewRegisters(),
+		BranchMode:       c.branchPolicy,
+		Predictor:        c.predictor,
+		Forwarding:       c.forwarding,
+		Ram:              c.memory,
+		Units:            defaultFunctionalUnits(),
+		Trace:            c.trace,
+		DelaySlots:       c.delaySlots,
+	}
+	switch {
+	case c.memorySize != 0:
+		cpu.Ram = NewDenseMemory(c.memorySize)
+	case cpu.Ram == nil:
+		cpu.Ram = NewDenseMemory(DefaultMemorySize)
+	}
+	if c.btbEntries != 0 {
+		cpu.BTB = NewBranchTargetBuffer(c.btbEntries, c.btbWays)
+	}
+	if c.rasDepth != 0 {
+		cpu.RAS = NewReturnAddressStack(c.rasDepth, c.rasOverflow)
+	}
+	for name, latency := range c.latencies {
+		cpu.Unit(name).Latency = latency
 	}
-	pipeline, err := NewPipeline(cpu,
-		new(IF1),
-		new(IF2),
-		new(IF3),
-		new(ID),
-		new(EX),
-		new(MEM1),
-		new(MEM2),
-		new(MEM3),
-		new(WB),
-	)
 
+	pipeline, err := NewPipeline(cpu, c.stages...)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	cpu.Pipeline = pipeline
-	return cpu
+	if c.width > 1 {
+		for _, stage := range pipeline.Stages {
+			stage.SetWidth(c.width)
+		}
+		cpu.Unit("EX").Width = c.width
+	}
+	if c.renaming != 0 {
+		cpu.Renaming = NewRenameTable(c.renaming, cpu.Registers)
+	}
+	if c.engine != nil {
+		cpu.Engine = c.engine(cpu)
+	}
+	return cpu, nil
 }
 
 func (cpu *CPU) Run(maximumCycles int) (err error) {
@@ -80,6 +164,13 @@ func (cpu *CPU) Run(maximumCycles int) (err error) {
 }
 
 func (cpu *CPU) Step() error {
+	if cpu.Engine != nil {
+		err := cpu.Engine.Step()
+		if cpu.Trace != nil && err == nil {
+			io.WriteString(cpu.Trace, cpu.Engine.String())
+		}
+		return err
+	}
 
 	// First Move instructions to next stage of pipeline
 	if err := cpu.Pipeline.TransferInstructions(); err != nil {
@@ -94,9 +185,19 @@ func (cpu *CPU) Step() error {
 
 	// If not, increase cycle count and execute pipeline
 	//fmt.Println("#################### CYCLE", cpu.Cycle, "####################")
+	if cpu.Renaming != nil && cpu.Cycle == 0 {
+		cpu.Renaming.load()
+	}
 	cpu.Cycle += 1
 
-	return cpu.Pipeline.Execute()
+	err := cpu.Pipeline.Execute()
+	if cpu.Renaming != nil {
+		cpu.Renaming.record()
+	}
+	if cpu.Trace != nil {
+		io.WriteString(cpu.Trace, cpu.RenderState())
+	}
+	return err
 }
 
 func (cpu *CPU) RenderState() string {
@@ -110,7 +211,7 @@ func (cpu *CPU) RenderState() string {
 		for _, iip := range cpu.Pipeline.ActiveInstructions() {
 			if iip == inst {
 				inPipeline = true
-				stalled := iip.Stage.Stalled()
+				stalled := iip.Stage.Stalled() && indexOfInstruction(iip.Stage.Leaving(), iip) < 0
 				if stalled {
 					//print("(s) %s", iip.OpCode())
 					print("(s)")
@@ -129,6 +230,15 @@ func (cpu *CPU) RenderState() string {
 			print("")
 		}
 	}
+	// latch contents, showing the values available for forwarding
+	for _, l := range cpu.Pipeline.Latches {
+		if len(l.Instructions) > 0 {
+			result.WriteString(" " + l.String())
+		}
+	}
+	if cpu.Renaming != nil {
+		result.WriteString(" " + cpu.Renaming.String())
+	}
 	result.WriteString("\n")
 	//fmt.Println("\nstate: ", result)
 	return string(result.Bytes())
@@ -157,41 +267,121 @@ func (cpu *CPU) RenderTimingForCycle(cycle int) string {
 	result := new(bytes.Buffer)
 	print := spacingHelper(6, result)
 	print("c#%d", cycle)
+	for _, inst := range cpu.Instructions {
+		print(cpu.timingCell(inst, cycle))
+	}
+	return string(result.Bytes())
+}
+
+// timingCell returns what the timing table shows for an instruction in cycle
+func (cpu *CPU) timingCell(inst *ExecutedInstruction, cycle int) string {
+	// fetch stages are shown in the cycles right before decode, stalls
+	// while fetching before them
+	fetch, decode := cpu.Pipeline.fetchStages()
 
+	switch {
+	case cycle < inst.CycleStart:
+		return "."
+	case cycle > inst.CycleFinish:
+		return ""
+	case cpu.Engine != nil && cycle == inst.CycleFlush:
+		return "(fl)"
+	case cpu.Engine != nil:
+		break
+	case cycle == inst.CycleStart && len(fetch) > 0:
+		return fetch[0]
+	// consider flushed cycles
+	case cycle == inst.CycleFlush:
+		return "(fl)"
+	case inst.CycleFlush != -1 && cycle < inst.CycleFlush:
+		return "(fl)"
+	case len(fetch) == 0:
+		// the decode stage fetches, stalls are shown until it is recorded
+		break
+	case cycle < inst.Stages[decode]-len(fetch)+1:
+		return "(s)"
+	case cycle < inst.Stages[decode]:
+		return fetch[len(fetch)-inst.Stages[decode]+cycle]
+	}
+	if stage, ok := inst.Cycles[cycle]; ok {
+		return stage
+	}
+	return "(s)"
+}
+
+// StallsInCycle returns the instructions stalled in cycle and the cause of
+// each stall. Instructions flushed later are left out.
+func (cpu *CPU) StallsInCycle(cycle int) map[*ExecutedInstruction]*Hazard {
+	result := make(map[*ExecutedInstruction]*Hazard)
 	for _, inst := range cpu.Instructions {
-		switch {
-		case cycle < inst.CycleStart:
-			print(".")
-		case cycle > inst.CycleFinish:
-			print("")
-		case cycle == inst.CycleStart:
-			print("IF1")
-		// consider flushed cycles
-		case cycle == inst.CycleFlush:
-			print("(fl)")
-		case inst.CycleFlush != -1 && cycle < inst.CycleFlush:
-			print("(fl)")
-		case cycle < inst.Stages["ID"]-2:
-			print("(s)")
-		case cycle == inst.Stages["ID"]-2:
-			print("IF2")
-		case cycle == inst.Stages["ID"]-1:
-			print("IF3")
-		default:
-			if stage, ok := inst.Cycles[cycle]; ok {
-				print(stage)
-			} else {
-				print("(s)")
+		if inst.CycleFlush != -1 {
+			continue
+		}
+		if cause, ok := inst.Stalls[cycle]; ok {
+			result[inst] = cause
+		}
+	}
+	return result
+}
+
+// RenderAnnotatedTiming renders the timing table with the causes of the
+// stalls shown in each cycle, e.g. "I#2 RAW on R1 from I#1". Stalls while
+// fetching are shown before the fetch stages, so each (s) is matched to the
+// instruction's stalls in order. Flushed instructions are shown as (fl) and
+// not annotated.
+func (cpu *CPU) RenderAnnotatedTiming() string {
+	causes := make([][]*Hazard, len(cpu.Instructions))
+	for n, inst := range cpu.Instructions {
+		if inst.CycleFlush != -1 {
+			continue
+		}
+		for cycle := inst.CycleStart; cycle <= cpu.Cycle; cycle++ {
+			if cause, ok := inst.Stalls[cycle]; ok {
+				causes[n] = append(causes[n], cause)
+			}
+		}
+	}
+
+	lines := strings.Split(cpu.RenderTiming(), "\n")
+	for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+		annotations := make([]string, 0)
+		for n, inst := range cpu.Instructions {
+			if cpu.timingCell(inst, cycle) != "(s)" || len(causes[n]) == 0 {
+				continue
 			}
+			annotations = append(annotations, fmt.Sprintf("I#%d %s", n+1, causes[n][0].Cause()))
+			causes[n] = causes[n][1:]
 		}
+		if len(annotations) > 0 {
+			lines[cycle] += "  " + strings.Join(annotations, "; ")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
 
+// readRegister reads a register operand through the hazard unit
+func (cpu *CPU) readRegister(r Register) (Word, error) {
+	if value, ok := cpu.operands[r]; ok {
+		return value, nil
 	}
+	return cpu.Pipeline.Hazards.Read(nil, r)
+}
 
-	return string(result.Bytes())
+// writeRegister writes a result back to the register file, under renaming
+// through the physical register of the instruction writing back. Writes to
+// R0 are dropped.
+func (cpu *CPU) writeRegister(r Register, value Word) error {
+	if r == R0 {
+		return nil
+	}
+	if cpu.Renaming.renames(r) && cpu.writing != nil {
+		return cpu.Renaming.write(cpu.writing, r, value)
+	}
+	return cpu.Registers.Set(r, value)
 }
 
 func (cpu *CPU) InstructionCacheEmpty() bool {
-	return cpu.InstructionPointer == len(cpu.InstructionCache)
+	return cpu.InstructionPointer >= len(cpu.InstructionCache)
 }
 
 func (lhs InstructionCache) Equals(rhs InstructionCache) bool {
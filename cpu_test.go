@@ -1,6 +1,8 @@
 package mips
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -8,7 +10,7 @@ import (
 
 var CPU_TESTS = map[string]string{
 	"raw_hazard": `REGISTERS
-R1 1
+R1 8
 MEMORY
 0 7
 CODE
@@ -24,12 +26,12 @@ Start: DADDI R1, R1, #-1
        BNEZ  R1, Start
        LD    R4, #0
 `, "basic": `REGISTERS
-R1 2
+R1 16
 R3 22
 MEMORY
 0 7
-1 6
-2 20
+8 6
+16 20
 CODE
 Loop: LD    R2,    0(R1) 
       DADD  R4,    R2,    R3
@@ -82,11 +84,16 @@ Next: LD    R6,    0(R5)
 `,
 }
 
-func TestRunningEmptyCPU(t *testing.T) {
-	cpu := NewCPU()
-	if cpu == nil {
-		t.Error("cpu == nil")
+func newTestCPU(t *testing.T, opts ...Option) *CPU {
+	cpu, err := NewCPU(opts...)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return cpu
+}
+
+func TestRunningEmptyCPU(t *testing.T) {
+	cpu := newTestCPU(t)
 	err := cpu.Run(100)
 	if err != nil {
 		t.Error(err)
@@ -101,13 +108,13 @@ func TestRAWHazard(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	//cpu.ForwardingEnabled = true
+	//cpu.Forwarding = ForwardAll
 	err = cpu.Run(35)
 	if err != nil {
 		t.Error(err)
 	}
-	if cpu.Ram[1] != 10 {
-		t.Fatal(cpu.Ram[1], "!=", 10)
+	if cpu.Ram.Word(8) != 10 {
+		t.Fatal(cpu.Ram.Word(8), "!=", 10)
 	}
 }
 
@@ -119,7 +126,7 @@ func TestBranching(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	cpu.ForwardingEnabled = true
+	cpu.Forwarding = ForwardAll
 	cpu.BranchMode = BranchPolicyPredictNotTaken
 	cpu.BranchMode = BranchPolicyPredictTaken
 	err = cpu.Run(35)
@@ -146,14 +153,14 @@ func TestRunningBasicProgram(t *testing.T) {
 		t.Error(err)
 	}
 	expected := `REGISTERS:
-R1 = 2
+R1 = 16
 R2 = 20
 R3 = 22
 R4 = 42
 MEMORY:
 0x0 = 7
-0x1 = 6
-0x2 = 42
+0x8 = 6
+0x10 = 42
 `
 	if cpu.String() != expected {
 		fmt.Println([]byte(cpu.String()))
@@ -176,7 +183,7 @@ func TestSameOutputRegardlessOfFlags(t *testing.T) {
 		timing := cpu.RenderTiming()
 
 		cpu, _ = ParseCPUString(test)
-		cpu.ForwardingEnabled = true
+		cpu.Forwarding = ForwardAll
 		cpu.BranchMode = BranchPolicyPredictTaken
 		if err := cpu.Run(100); err != nil {
 			t.Fatal(testName, "f, bt", err)
@@ -186,7 +193,7 @@ func TestSameOutputRegardlessOfFlags(t *testing.T) {
 		timingPT := cpu.RenderTiming()
 
 		cpu, _ = ParseCPUString(test)
-		cpu.ForwardingEnabled = true
+		cpu.Forwarding = ForwardAll
 		cpu.BranchMode = BranchPolicyPredictNotTaken
 		if err := cpu.Run(100); err != nil {
 			t.Fatal(testName, "f, bnt", err)
@@ -196,10 +203,10 @@ func TestSameOutputRegardlessOfFlags(t *testing.T) {
 		timingPNT := cpu.RenderTiming()
 
 		if a != b {
-			t.Error("'%s' != '%s'", a, b)
+			t.Errorf("'%s' != '%s'", a, b)
 		}
 		if b != c {
-			t.Error("'%s' != '%s'", b, c)
+			t.Errorf("'%s' != '%s'", b, c)
 		}
 		_, _, _ = timing, timingPNT, timingPT
 		/*
@@ -217,3 +224,1980 @@ func TestSameOutputRegardlessOfFlags(t *testing.T) {
 		*/
 	}
 }
+
+// runs a program under each combination of forwarding and branch policy and
+// returns the resulting cpus
+func runAllModes(t *testing.T, program string) []*CPU {
+	result := make([]*CPU, 0)
+	for _, mode := range []struct {
+		forwarding bool
+		branchMode BranchPolicy
+	}{
+		{false, BranchPolicyFlush},
+		{true, BranchPolicyPredictTaken},
+		{true, BranchPolicyPredictNotTaken},
+		{true, BranchPolicyPredictDynamic},
+	} {
+		opts := []Option{WithForwarding(mode.forwarding), WithBranchPolicy(mode.branchMode)}
+		if mode.branchMode == BranchPolicyPredictDynamic {
+			opts = append(opts, WithBranchPredictor(NewTwoBitPredictor(16)))
+		}
+		cpu, err := ParseCPUString(program, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, cpu)
+	}
+	return result
+}
+
+var ALU_TESTS = []struct {
+	code     string
+	expected Word
+}{
+	{"DADD   R3, R1, R2", 12},
+	{"DADDI  R3, R1, #-3", 7},
+	{"DADDU  R3, R4, R4", 0xfffffffffffffffe},
+	{"DADDIU R3, R4, #1", 0},
+	{"DSUB   R3, R1, R2", 8},
+	{"DSUB   R3, R2, R1", 0xfffffffffffffff8},
+	{"DSUBU  R3, R1, R2", 8},
+	{"AND    R3, R1, R2", 2},
+	{"ANDI   R3, R4, #-1", 0xffff},
+	{"OR     R3, R1, R2", 10},
+	{"ORI    R3, R1, #5", 15},
+	{"XOR    R3, R1, R2", 8},
+	{"XORI   R3, R4, #255", 0xffffffffffffff00},
+	{"NOR    R3, R1, R2", 0xfffffffffffffff5},
+	{"SLT    R3, R4, R1", 1},
+	{"SLT    R3, R1, R4", 0},
+	{"SLTI   R3, R4, #0", 1},
+	{"SLTI   R3, R1, #10", 0},
+	{"SLTU   R3, R4, R1", 0},
+	{"SLTU   R3, R1, R4", 1},
+	{"SLTIU  R3, R1, #-1", 1},
+	{"SLTIU  R3, R1, #5", 0},
+	{"LUI    R3, #1", 0x10000},
+	{"LUI    R3, #-32768", 0xffffffff80000000},
+}
+
+func TestALUInstructions(t *testing.T) {
+	for _, test := range ALU_TESTS {
+		program := fmt.Sprintf(`REGISTERS
+R1 10
+R2 2
+R4 -1
+MEMORY
+CODE
+      %s
+`, test.code)
+		for _, cpu := range runAllModes(t, program) {
+			if actual := cpu.Registers.Get(R3); actual != test.expected {
+				t.Errorf("%s: R3 = %s, expected %s", test.code, actual, test.expected)
+			}
+		}
+	}
+}
+
+func TestALUDependencies(t *testing.T) {
+	program := `REGISTERS
+R1 6
+R2 3
+MEMORY
+CODE
+      DSUB  R3, R1, R2
+      SLT   R4, R2, R3
+      XORI  R5, R4, #3
+      NOR   R6, R5, R0
+      LUI   R7, #2
+      OR    R8, R7, R5
+`
+	for _, cpu := range runAllModes(t, program) {
+		for register, expected := range map[Register]Word{
+			R3: 3,
+			R4: 0,
+			R5: 3,
+			R6: 0xfffffffffffffffc,
+			R7: 0x20000,
+			R8: 0x20003,
+		} {
+			if actual := cpu.Registers.Get(register); actual != expected {
+				t.Errorf("%s = %s, expected %s", register, actual, expected)
+			}
+		}
+	}
+}
+
+var SHIFT_TESTS = []struct {
+	code     string
+	expected Word
+}{
+	{"DSLL   R3, R2, 4", 0x90},
+	{"DSLL   R3, R1, #1", 0xffffffffffffffe0},
+	{"DSRL   R3, R2, 1", 0x4},
+	{"DSRL   R3, R1, 4", 0x0fffffffffffffff},
+	{"DSRA   R3, R1, 2", 0xfffffffffffffffc},
+	{"DSRA   R3, R2, 2", 0x2},
+	{"DSLL32 R3, R2, 0", 0x900000000},
+	{"DSLL32 R3, R1, 31", 0},
+	{"DSRL32 R3, R1, 0", 0xffffffff},
+	{"DSRA32 R3, R1, 0", 0xffffffffffffffff},
+	{"DSRA32 R3, R4, 4", 0xfffffffff8000000},
+	{"DSLLV  R3, R2, R5", 0x90},
+	{"DSLLV  R3, R2, R6", 0x8000000000000000},
+	{"DSRLV  R3, R1, R5", 0x0fffffffffffffff},
+	{"DSRAV  R3, R1, R5", 0xffffffffffffffff},
+	{"DSRAV  R3, R4, R6", 0xffffffffffffffff},
+	{"DSRAV  R3, R4, R7", 0xffffffff80000000},
+}
+
+func TestShiftInstructions(t *testing.T) {
+	for _, test := range SHIFT_TESTS {
+		program := fmt.Sprintf(`REGISTERS
+R1 -16
+R2 9
+R4 -9223372036854775808
+R5 4
+R6 63
+R7 96
+MEMORY
+CODE
+      %s
+`, test.code)
+		for _, cpu := range runAllModes(t, program) {
+			if actual := cpu.Registers.Get(R3); actual != test.expected {
+				t.Errorf("%s: R3 = %s, expected %s", test.code, actual, test.expected)
+			}
+		}
+	}
+}
+
+var BRANCH_TESTS = []struct {
+	name     string
+	program  string
+	expected map[Register]Word
+}{
+	{"beq_loop", `REGISTERS
+R2 5
+MEMORY
+CODE
+Loop: DADDI R1, R1, #1
+      DADDI R3, R3, #2
+      BEQ   R1, R2, Done
+      J     Loop
+Done: DADDI R4, R3, #0
+`, map[Register]Word{R1: 5, R3: 10, R4: 10}},
+	{"bne_loop", `REGISTERS
+R2 4
+MEMORY
+CODE
+Loop: DADDI R1, R1, #1
+      BNE   R1, R2, Loop
+      DADDI R3, R1, #1
+`, map[Register]Word{R1: 4, R3: 5}},
+	{"beqz", `REGISTERS
+R1 3
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      DADDI R2, R2, #1
+      BEQZ  R1, Done
+      J     Loop
+      DADDI R3, R0, #99
+Done: DADDI R4, R2, #0
+`, map[Register]Word{R1: 0, R2: 3, R3: 0, R4: 3}},
+	{"jal_jr", `REGISTERS
+R1 3
+MEMORY
+CODE
+      JAL   Incr
+      DADDI R5, R2, #0
+      JAL   Incr
+      DADDI R6, R2, #0
+      J     End
+Incr: DADDI R2, R2, #1
+      JR    R31
+End:  DADDI R7, R0, #7
+`, map[Register]Word{R2: 2, R5: 1, R6: 2, R7: 7, R31: 3}},
+	{"jalr", `REGISTERS
+R4 4
+R8 6
+MEMORY
+CODE
+       JALR  R4
+       DADDI R5, R0, #1
+       JALR  R10, R8
+       J     End
+Func:  DADDI R2, R2, #3
+       JR    R31
+Func2: DADDI R2, R2, #4
+       JR    R10
+End:   DADDI R6, R10, #0
+`, map[Register]Word{R2: 7, R5: 1, R6: 3, R10: 3, R31: 1}},
+}
+
+func TestBranchesAndJumps(t *testing.T) {
+	for _, test := range BRANCH_TESTS {
+		for _, cpu := range runAllModes(t, test.program) {
+			for register, expected := range test.expected {
+				if actual := cpu.Registers.Get(register); actual != expected {
+					t.Errorf("%s: %s = %s, expected %s", test.name, register, actual, expected)
+				}
+			}
+		}
+	}
+}
+
+var MULDIV_TESTS = []struct {
+	code     string
+	expected map[Register]Word
+}{
+	{"DMUL   R3, R1, R2", map[Register]Word{R3: 168}},
+	{"DMUL   R3, R1, R8", map[Register]Word{R3: 0xffffffffffffff88}},
+	{"DMULT  R1, R2", map[Register]Word{HI: 0, LO: 168}},
+	{"DMULT  R1, R8", map[Register]Word{HI: 0xffffffffffffffff, LO: 0xffffffffffffff88}},
+	{"DMULT  R4, R4", map[Register]Word{HI: 0x3fffffffffffffff, LO: 1}},
+	{"DDIV   R1, R2", map[Register]Word{HI: 0xfffffffffffffffd, LO: 3}},
+	{"DDIV   R1, R8", map[Register]Word{HI: 0xfffffffffffffffc, LO: 0xfffffffffffffffc}},
+	{"DDIVU  R4, R7", map[Register]Word{HI: 7, LO: 0x0ccccccccccccccc}},
+	{"DDIVU  R1, R8", map[Register]Word{HI: 2, LO: 0x333333333333332e}},
+	{"DDIV   R1, R0", map[Register]Word{HI: 0, LO: 0}},
+}
+
+func TestMultiplyDivide(t *testing.T) {
+	for _, test := range MULDIV_TESTS {
+		program := fmt.Sprintf(`REGISTERS
+R1 -24
+R2 -7
+R4 9223372036854775807
+R7 10
+R8 5
+MEMORY
+CODE
+      %s
+      MFHI   R5
+      MFLO   R6
+`, test.code)
+		for _, cpu := range runAllModes(t, program) {
+			for register, expected := range test.expected {
+				if actual := cpu.Registers.Get(register); actual != expected {
+					t.Errorf("%s: %s = %s, expected %s", test.code, register, actual, expected)
+				}
+			}
+			if cpu.Registers.Get(R5) != cpu.Registers.Get(HI) || cpu.Registers.Get(R6) != cpu.Registers.Get(LO) {
+				t.Errorf("%s: MFHI/MFLO did not copy HI/LO", test.code)
+			}
+		}
+	}
+}
+
+// returns the first cycle in which an instruction was in the named stage
+func firstCycleIn(i *ExecutedInstruction, stage string) int {
+	for cycle := i.CycleStart; cycle <= i.CycleFinish; cycle++ {
+		if i.Cycles[cycle] == stage {
+			return cycle
+		}
+	}
+	return -1
+}
+
+func TestMultiCycleTiming(t *testing.T) {
+	cpu, err := ParseCPUString(`REGISTERS
+R1 6
+R2 2
+MEMORY
+CODE
+      DMUL  R3, R1, R2
+      DADD  R5, R1, R2
+      DADD  R6, R1, R2
+      DDIV  R1, R2
+      DDIVU R1, R2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Forwarding = ForwardAll
+	cpu.Unit("M").Latency = 3
+	cpu.Unit("DIV").Latency = 4
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	mul, add1, add2, div1, div2 := cpu.Instructions[0], cpu.Instructions[1], cpu.Instructions[2], cpu.Instructions[3], cpu.Instructions[4]
+
+	if mul.Stages["M3"] != mul.Stages["M1"]+2 || mul.Stages["MEM1"] != mul.Stages["M3"]+1 {
+		t.Errorf("unexpected multiply timing %v", mul.Stages)
+	}
+
+	// the first DADD overtakes the multiply, the second finishes in the
+	// same cycle and must wait for it to leave EX (structural hazard)
+	if add1.Stages["MEM1"] >= mul.Stages["MEM1"] {
+		t.Errorf("DADD should complete before DMUL: %v %v", add1.Stages, mul.Stages)
+	}
+	if add2.Stages["EX"] != mul.Stages["M3"] || add2.Stages["MEM1"] != add2.Stages["EX"]+2 {
+		t.Errorf("expected DADD to stall one cycle in EX: %v", add2.Stages)
+	}
+
+	// the divider is not pipelined, the second divide starts as the first leaves
+	if div1.Stages["MEM1"] != firstCycleIn(div1, "DIV")+4 {
+		t.Errorf("unexpected divide timing %v", div1.Cycles)
+	}
+	if firstCycleIn(div2, "DIV") != div1.Stages["MEM1"] {
+		t.Errorf("second divide should start when the first leaves the divider: %v", div2.Cycles)
+	}
+
+	if !strings.Contains(cpu.RenderTiming(), "M3") {
+		t.Error("timing should show multiplier stages")
+	}
+}
+
+func TestWAWHazard(t *testing.T) {
+	program := `REGISTERS
+R1 6
+R2 7
+MEMORY
+CODE
+      DMUL  R3, R1, R2
+      DADDI R3, R0, #1
+      DADDI R4, R3, #1
+`
+	for _, cpu := range runAllModes(t, program) {
+		if cpu.Registers.Get(R3) != 1 || cpu.Registers.Get(R4) != 2 {
+			t.Errorf("R3 = %d, R4 = %d, expected 1, 2", cpu.Registers.Get(R3), cpu.Registers.Get(R4))
+		}
+		mul, addi := cpu.Instructions[0], cpu.Instructions[1]
+		if addi.Stages["WB"] <= mul.Stages["WB"] {
+			t.Errorf("DADDI wrote back in cycle %d before DMUL in %d", addi.Stages["WB"], mul.Stages["WB"])
+		}
+	}
+}
+
+func TestFloatingPoint(t *testing.T) {
+	program := `REGISTERS
+R1 8
+F2 1.5
+F4 2.25
+MEMORY
+8 3.0
+CODE
+      L.D    F6,  0(R1)
+      ADD.D  F8,  F6,  F2
+      SUB.D  F10, F4,  F2
+      MUL.D  F12, F6,  F4
+      DIV.D  F14, F6,  F2
+      S.D    F8,  8(R1)
+      S.D    0(R1), F12
+`
+	for _, cpu := range runAllModes(t, program) {
+		for register, expected := range map[Register]float64{
+			F6:  3,
+			F8:  4.5,
+			F10: 0.75,
+			F12: 6.75,
+			F14: 2,
+		} {
+			if actual := cpu.Registers.Get(register).Float(); actual != expected {
+				t.Errorf("%s = %g, expected %g", register, actual, expected)
+			}
+		}
+		if cpu.Ram.Word(16).Float() != 4.5 || cpu.Ram.Word(8).Float() != 6.75 {
+			t.Errorf("stores wrote %g, %g", cpu.Ram.Word(16).Float(), cpu.Ram.Word(8).Float())
+		}
+	}
+}
+
+func TestFloatingPointBranches(t *testing.T) {
+	program := `REGISTERS
+F2 1.0
+F4 3.0
+MEMORY
+CODE
+Loop: ADD.D  F0, F0, F2
+      C.LT.D F0, F4
+      BC1T   Loop
+      C.LT.D F4, F0
+      BC1F   Done
+      ADD.D  F6, F0, F0
+Done: ADD.D  F8, F0, F2
+`
+	for _, cpu := range runAllModes(t, program) {
+		if f := cpu.Registers.Get(F0).Float(); f != 3 {
+			t.Errorf("F0 = %g, expected 3", f)
+		}
+		if f := cpu.Registers.Get(F6).Float(); f != 0 {
+			t.Errorf("F6 = %g, BC1F should have been taken", f)
+		}
+		if f := cpu.Registers.Get(F8).Float(); f != 4 {
+			t.Errorf("F8 = %g, expected 4", f)
+		}
+	}
+}
+
+func TestFloatingPointTiming(t *testing.T) {
+	cpu, err := ParseCPUString(`REGISTERS
+MEMORY
+CODE
+      ADD.D  F2, F0, F0
+      MUL.D  F4, F0, F0
+      DIV.D  F6, F0, F0
+      DIV.D  F8, F0, F0
+      ADD.D  F10, F2, F0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Forwarding = ForwardAll
+	cpu.Unit("DIV").Latency = 5
+	if err := cpu.Run(200); err != nil {
+		t.Fatal(err)
+	}
+	add, mul, div1, div2, dependent := cpu.Instructions[0], cpu.Instructions[1], cpu.Instructions[2], cpu.Instructions[3], cpu.Instructions[4]
+	for n := 1; n <= 4; n++ {
+		if add.Stages[fmt.Sprintf("A%d", n)] != add.Stages["A1"]+n-1 {
+			t.Errorf("unexpected FP add timing %v", add.Stages)
+		}
+	}
+	if mul.Stages["M7"] != mul.Stages["M1"]+6 {
+		t.Errorf("unexpected FP multiply timing %v", mul.Stages)
+	}
+	if firstCycleIn(div2, "DIV") != div1.Stages["MEM1"] {
+		t.Errorf("divider is not pipelined, second divide should wait: %v %v", div1.Cycles, div2.Cycles)
+	}
+	if dependent.Stages["A1"] <= add.Stages["A4"] {
+		t.Errorf("dependent add should wait for F2: %v", dependent.Stages)
+	}
+	timing := cpu.RenderTiming()
+	for _, stage := range []string{"A4", "M7", "DIV"} {
+		if !strings.Contains(timing, stage) {
+			t.Errorf("timing should show %s", stage)
+		}
+	}
+}
+
+var SIZED_MEMORY_TESTS = []struct {
+	code       string
+	endianness Endianness
+	expected   Word
+}{
+	{"LD  R3, 0(R1)", BigEndian, 0x0123456789abcdef},
+	{"LW  R3, 0(R1)", BigEndian, 0x01234567},
+	{"LW  R3, 4(R1)", BigEndian, 0xffffffff89abcdef},
+	{"LWU R3, 4(R1)", BigEndian, 0x89abcdef},
+	{"LH  R3, 6(R1)", BigEndian, 0xffffffffffffcdef},
+	{"LHU R3, 6(R1)", BigEndian, 0xcdef},
+	{"LB  R3, 1(R1)", BigEndian, 0x23},
+	{"LB  R3, 7(R1)", BigEndian, 0xffffffffffffffef},
+	{"LBU R3, 7(R1)", BigEndian, 0xef},
+	{"LD  R3, 0(R1)", LittleEndian, 0x0123456789abcdef},
+	{"LW  R3, 0(R1)", LittleEndian, 0xffffffff89abcdef},
+	{"LWU R3, 0(R1)", LittleEndian, 0x89abcdef},
+	{"LH  R3, 6(R1)", LittleEndian, 0x0123},
+	{"LB  R3, 0(R1)", LittleEndian, 0xffffffffffffffef},
+	{"LBU R3, 1(R1)", LittleEndian, 0xcd},
+}
+
+func TestSizedLoads(t *testing.T) {
+	for _, test := range SIZED_MEMORY_TESTS {
+		cpu, err := ParseCPUString(fmt.Sprintf(`REGISTERS
+R1 8
+MEMORY
+CODE
+      %s
+`, test.code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cpu.Ram.SetEndianness(test.endianness)
+		cpu.Ram.Store(8, 8, 0x0123456789abcdef)
+		if err := cpu.Run(100); err != nil {
+			t.Fatal(test.code, err)
+		}
+		if actual := cpu.Registers.Get(R3); actual != test.expected {
+			t.Errorf("%s (%d): R3 = %s, expected %s", test.code, test.endianness, actual, test.expected)
+		}
+	}
+}
+
+func TestSizedStores(t *testing.T) {
+	program := `REGISTERS
+R1 8
+R2 -2
+MEMORY
+CODE
+      SD  0(R1), R2
+      SW  0(R1), R0
+      SH  4(R1), R0
+      SB  7(R1), R0
+      SB  R2, 17(R1)
+      LD  R3, 16(R1)
+`
+	for _, cpu := range runAllModes(t, program) {
+		if actual := cpu.Ram.Word(8); actual != 0xff00 {
+			t.Errorf("Mem[8] = %s, expected 0xff00", actual)
+		}
+		if actual := cpu.Registers.Get(R3); actual != 0x00fe000000000000 {
+			t.Errorf("R3 = %s, expected 0xfe000000000000", actual)
+		}
+	}
+}
+
+func TestAddressError(t *testing.T) {
+	for _, code := range []string{
+		"LD  R3, 4(R1)",
+		"LW  R3, 2(R1)",
+		"LH  R3, 1(R1)",
+		"SD  1(R1), R3",
+		"SH  3(R1), R3",
+	} {
+		cpu, err := ParseCPUString(fmt.Sprintf(`REGISTERS
+R1 8
+MEMORY
+CODE
+      %s
+`, code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cpu.Run(100)
+		var addressError *AddressError
+		if !errors.As(err, &addressError) || !strings.Contains(err.Error(), "Address error") {
+			t.Errorf("%s: expected address error, got %v", code, err)
+		}
+	}
+}
+
+func TestMemoryFault(t *testing.T) {
+	for _, test := range []struct {
+		code    string
+		address Word
+		stage   string
+	}{
+		{"LD  R3, 7936(R0)", 7936, "MEM1"},
+		{"LD  R3, 0(R1)", 1 << 40, "MEM1"},
+		{"SD  -8(R0), R1", 0xfffffffffffffff8, "MEM1"},
+		{"SB  -1(R0), R1", 0xffffffffffffffff, "MEM1"},
+		{"LW  R3, 7932(R0)", 7932, ""},
+	} {
+		cpu, err := ParseCPUString(fmt.Sprintf(`REGISTERS
+R1 1099511627776
+MEMORY
+CODE
+      DADDI R2, R0, #1
+      %s
+      DADDI R4, R0, #1
+`, test.code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cpu.Run(100)
+		if test.stage == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.code, err)
+			}
+			continue
+		}
+		var fault *MemoryFault
+		if !errors.As(err, &fault) {
+			t.Fatalf("%s: expected MemoryFault, got %v", test.code, err)
+		}
+		if fault.Err != AddressOutOfRange || fault.Address != test.address || fault.Stage != test.stage {
+			t.Errorf("%s: unexpected fault %+v", test.code, fault)
+		}
+		if fault.Instruction != cpu.Instructions[1] || fault.Cycle != fault.Instruction.Stages["EX"]+1 {
+			t.Errorf("%s: fault should identify the instruction and cycle: %+v", test.code, fault)
+		}
+	}
+
+	// the engines report the fault as the pipeline does
+	for _, opts := range [][]Option{
+		{WithTomasulo(nil)},
+		{WithTomasulo(nil), WithReorderBuffer(8)},
+		{WithScoreboard(nil)},
+	} {
+		for _, code := range []string{"LD  R3, 7936(R0)", "SD  -8(R0), R1"} {
+			cpu, err := ParseCPUString(fmt.Sprintf(`REGISTERS
+R1 1
+MEMORY
+CODE
+      DADDI R2, R0, #1
+      %s
+      DADDI R4, R0, #1
+`, code), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cpu.Run(100)
+			var fault *MemoryFault
+			if !errors.As(err, &fault) {
+				t.Fatalf("%s: expected MemoryFault, got %v", code, err)
+			}
+			if fault.Err != AddressOutOfRange || fault.Instruction != cpu.Instructions[1] || fault.Stage == "" || fault.Cycle == 0 {
+				t.Errorf("%s: unexpected fault %+v", code, fault)
+			}
+		}
+	}
+}
+
+func TestSparseMemory(t *testing.T) {
+	program := `REGISTERS
+R1 4611686018427387904
+MEMORY
+4611686018427387904 42
+8 7
+CODE
+      LD  R2, 0(R1)
+      SD  8(R1), R2
+      LD  R3, 8(R0)
+      SD  -8(R0), R3
+`
+	cpu, err := ParseCPUString(program, WithMemory(NewSparseMemory(MaxMemorySize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R2) != 42 || cpu.Ram.Word(0x4000000000000008) != 42 {
+		t.Errorf("expected 42 to be loaded and stored at a high address:\n%s", cpu)
+	}
+	expected := `0x8 = 7
+0x4000000000000000 = 42
+0x4000000000000008 = 42
+0xfffffffffffffff8 = 7
+`
+	if cpu.Ram.String() != expected {
+		t.Errorf("'%s' != '%s'", cpu.Ram.String(), expected)
+	}
+
+	// the same program faults with the default dense memory
+	if _, err := ParseCPUString(program); err == nil {
+		t.Error("expected dense memory to reject a high address")
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	program := `REGISTERS
+MEMORY
+56 1
+CODE
+      LD  R2, 56(R0)
+      LD  R3, 64(R0)
+`
+	for _, memory := range []Memory{NewDenseMemory(64), NewSparseMemory(64)} {
+		cpu, err := ParseCPUString(program, WithMemory(memory))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fault *MemoryFault
+		if err := cpu.Run(100); !errors.As(err, &fault) || fault.Address != 64 {
+			t.Fatalf("expected fault at 64, got %v", err)
+		}
+		if fault.Instruction != cpu.Instructions[1] {
+			t.Errorf("expected the second load to fault, not %s", fault.Instruction)
+		}
+	}
+
+	cpu := newTestCPU(t, WithMemorySize(128))
+	if cpu.Ram.Size() != 128 {
+		t.Errorf("memory size %d, expected 128", cpu.Ram.Size())
+	}
+}
+
+func TestOptions(t *testing.T) {
+	trace := new(bytes.Buffer)
+	cpu, err := ParseCPUString(CPU_TESTS["basic"],
+		WithForwarding(true),
+		WithBranchPolicy(BranchPolicyPredictTaken),
+		WithMemory(NewSparseMemory(MaxMemorySize)),
+		WithLatency("M", 3),
+		WithTrace(trace),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Forwarding != ForwardAll || cpu.BranchMode != BranchPolicyPredictTaken {
+		t.Error("forwarding and branch policy not applied")
+	}
+	if cpu.Ram.Size() != MaxMemorySize {
+		t.Errorf("memory size %d, expected %d", cpu.Ram.Size(), Word(MaxMemorySize))
+	}
+	if cpu.Unit("M").Latency != 3 {
+		t.Errorf("multiplier latency %d, expected 3", cpu.Unit("M").Latency)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(trace.String(), "\n") != cpu.Cycle {
+		t.Errorf("expected a trace line per cycle, got:\n%s", trace)
+	}
+
+	// a pipeline without IF2/IF3/MEM2 still runs programs under the flush policy
+	cpu, err = ParseCPUString(CPU_TESTS["basic"], WithPipeline(
+		new(IF1), new(ID), new(EX), new(MEM1), new(MEM3), new(WB),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Ram.Word(16) != 42 {
+		t.Errorf("expected 42 at 0x10, got %d", cpu.Ram.Word(16))
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"nil memory":             {WithMemory(nil)},
+		"tiny memory":            {WithMemorySize(4)},
+		"memory and size":        {WithMemory(NewSparseMemory(1024)), WithMemorySize(1024)},
+		"branch policy":          {WithBranchPolicy(42)},
+		"unknown unit":           {WithLatency("X", 3)},
+		"zero latency":           {WithLatency("M", 0)},
+		"empty pipeline":         {WithPipeline()},
+		"duplicate stage":        {WithPipeline(new(IF1), new(ID), new(ID), new(EX), new(MEM1), new(MEM3), new(WB))},
+		"stage order":            {WithPipeline(new(IF1), new(EX), new(ID), new(MEM1), new(MEM3), new(WB))},
+		"missing stage":          {WithPipeline(new(IF1), new(ID), new(EX), new(MEM1), new(WB))},
+		"prediction without IF2": {WithBranchPolicy(BranchPolicyPredictTaken), WithPipeline(new(IF1), new(ID), new(EX), new(MEM1), new(MEM3), new(WB))},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFiveStagePipeline(t *testing.T) {
+	modes := []struct {
+		forwarding bool
+		branchMode BranchPolicy
+	}{
+		{false, BranchPolicyFlush},
+		{true, BranchPolicyPredictTaken},
+		{true, BranchPolicyPredictNotTaken},
+	}
+	for name, program := range CPU_TESTS {
+		for _, mode := range modes {
+			nine, err := ParseCPUString(program,
+				WithForwarding(mode.forwarding),
+				WithBranchPolicy(mode.branchMode),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			five, err := ParseCPUString(program,
+				WithPipeline(FiveStagePipeline()...),
+				WithForwarding(mode.forwarding),
+				WithBranchPolicy(mode.branchMode),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := nine.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if err := five.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if nine.String() != five.String() {
+				t.Errorf("%s: five stage result '%s' != '%s'", name, five, nine)
+			}
+			if five.Cycle >= nine.Cycle {
+				t.Errorf("%s: five stages took %d cycles, nine %d", name, five.Cycle, nine.Cycle)
+			}
+		}
+	}
+
+	// load-use: DADD stalls one cycle waiting for LD to leave MEM
+	cpu, err := ParseCPUString(CPU_TESTS["basic"],
+		WithPipeline(FiveStagePipeline()...),
+		WithForwarding(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	ld, dadd, sd := cpu.Instructions[0], cpu.Instructions[1], cpu.Instructions[2]
+	if ld.Stages["MEM"] != 4 || ld.CycleFinish != 5 {
+		t.Errorf("unexpected LD timing %v", ld.Cycles)
+	}
+	if dadd.Stages["ID"] != 4 || sd.CycleFinish != 8 {
+		t.Errorf("unexpected DADD/SD timing %v %v", dadd.Cycles, sd.Cycles)
+	}
+	timing := cpu.RenderTimingForCycle(2)
+	if fields := strings.Fields(timing); strings.Join(fields, " ") != "c#2 ID IF ." {
+		t.Errorf("unexpected timing for cycle 2: '%s'", timing)
+	}
+}
+
+func TestLatches(t *testing.T) {
+	trace := new(bytes.Buffer)
+	cpu, err := ParseCPUString(`REGISTERS
+R1 5
+MEMORY
+8 7
+CODE
+      DADDI R2, R1, #3
+      LD    R3, 8(R0)
+      DADD  R4, R2, R3
+`, WithForwarding(true), WithTrace(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, l := range cpu.Pipeline.Latches {
+		names = append(names, l.Name)
+	}
+	if strings.Join(names, " ") != "EX/MEM1 MEM1/MEM2 MEM2/MEM3 MEM3/WB" {
+		t.Errorf("unexpected latches %v", names)
+	}
+
+	// the register file is only written in WB, values are forwarded from the
+	// latches before that
+	for cpu.Step() == nil {
+		if len(cpu.Instructions) < 3 {
+			continue
+		}
+		if cpu.Instructions[0].CycleFinish == -1 && cpu.Registers.Get(R2) != 0 {
+			t.Errorf("R2 written before DADDI reached WB in cycle %d", cpu.Cycle)
+		}
+		if cpu.Instructions[1].CycleFinish == -1 && cpu.Registers.Get(R3) != 0 {
+			t.Errorf("R3 written before LD reached WB in cycle %d", cpu.Cycle)
+		}
+	}
+	if v, ok := cpu.Instructions[2].Result(R4); !ok || v != 15 || cpu.Registers.Get(R4) != 15 {
+		t.Errorf("expected R4 = 15, got %d", cpu.Registers.Get(R4))
+	}
+	// DADD reads R3 from the MEM3/WB latch in the cycle LD loads it
+	if cpu.Instructions[2].Stages["ID"] != cpu.Instructions[1].Stages["MEM3"] {
+		t.Errorf("expected DADD to decode with LD in MEM3: %v %v", cpu.Instructions[1].Cycles, cpu.Instructions[2].Cycles)
+	}
+	if strings.Contains(trace.String(), "MEM3/WB[I#2 R3=7]") == false {
+		t.Errorf("expected the loaded value in the trace:\n%s", trace)
+	}
+}
+
+func TestForwardingPaths(t *testing.T) {
+	program := `REGISTERS
+MEMORY
+CODE
+      DADDI R1, R0, #1
+      DADD  R2, R1, R1
+`
+	for _, test := range []struct {
+		paths ForwardingPath
+		stage string // DADD decodes while DADDI is in this stage
+		extra int    // or this many cycles after
+	}{
+		{ForwardAll, "EX", 0},
+		{ForwardEXtoEX, "EX", 0},
+		{ForwardMEMtoEX, "MEM1", 0},
+		{ForwardMEM3toID, "MEM3", 0},
+		{ForwardWBtoID, "WB", 0},
+		{0, "WB", 1},
+	} {
+		cpu, err := ParseCPUString(program, WithForwardingPaths(test.paths))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(100); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.Registers.Get(R2) != 2 {
+			t.Errorf("%s: R2 = %d, expected 2", test.paths, cpu.Registers.Get(R2))
+		}
+		daddi, dadd := cpu.Instructions[0], cpu.Instructions[1]
+		if dadd.Stages["ID"] != daddi.Stages[test.stage]+test.extra {
+			t.Errorf("%s: DADD decoded in cycle %d, expected %d", test.paths, dadd.Stages["ID"], daddi.Stages[test.stage]+test.extra)
+		}
+	}
+
+	if _, err := NewCPU(WithForwardingPaths(ForwardAll + 1)); err == nil {
+		t.Error("expected an error for unknown forwarding paths")
+	}
+	cpu, err := NewCPU(WithForwarding(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Forwarding != ForwardRegisterFile {
+		t.Errorf("expected only the split-cycle register file without forwarding, got %s", cpu.Forwarding)
+	}
+}
+
+func TestHazardDetection(t *testing.T) {
+	cpu, err := ParseCPUString(`REGISTERS
+R1 6
+R2 2
+MEMORY
+CODE
+      DADD  R3, R1, R2
+      DSUB  R4, R3, R2
+      DMUL  R5, R1, R2
+      DADD  R5, R1, R1
+      DIV.D F3, F1, F2
+      DIV.D F4, F1, F2
+      BEQZ  R0, End
+      DADD  R6, R1, R1
+End:  DADD  R7, R1, R1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hazards := make(map[HazardKind][]*Hazard)
+	for err = cpu.Step(); err == nil; err = cpu.Step() {
+		for _, h := range cpu.Pipeline.Hazards.Detected {
+			hazards[h.Kind] = append(hazards[h.Kind], h)
+		}
+	}
+	if err != CPUFinished {
+		t.Fatal(err)
+	}
+
+	if raw := hazards[HazardRAW]; len(raw) == 0 || raw[0].Register != R3 || raw[0].Producer != cpu.Instructions[0] || raw[0].Instruction != cpu.Instructions[1] {
+		t.Errorf("expected DSUB to wait on R3 from DADD, got %v", raw)
+	}
+	if waw := hazards[HazardWAW]; len(waw) == 0 || waw[0].Register != R5 || waw[0].Producer != cpu.Instructions[2] {
+		t.Errorf("expected DADD to wait on R5 from DMUL, got %v", waw)
+	}
+	if s := hazards[HazardStructural]; len(s) == 0 || s[0].Unit != "DIV" || s[0].Producer != cpu.Instructions[4] {
+		t.Errorf("expected the second DIV.D to wait for the divider, got %v", s)
+	}
+	if c := hazards[HazardControl]; len(c) == 0 || c[0].Instruction.OpCode() != "BEQZ" {
+		t.Errorf("expected a control hazard from BEQZ, got %v", c)
+	}
+	if len(hazards[HazardWAR]) != 0 {
+		t.Errorf("WAR hazards can not occur with in order reads: %v", hazards[HazardWAR])
+	}
+	if cpu.Registers.Get(R6) != 0 || cpu.Registers.Get(R7) != 12 {
+		t.Errorf("unexpected result\n%s", cpu.Registers)
+	}
+
+	// decode returns the operands it read, for ID to use
+	cpu, err = ParseCPUString("REGISTERS\nR1 6\nR2 2\nMEMORY\nCODE\n      DADD  R3, R1, R2\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(cpu.Instructions) == 0 || cpu.Instructions[0].Stages["ID"] == 0 {
+		if err := cpu.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	operands, err := cpu.Pipeline.Hazards.Decode(cpu.Instructions[0])
+	if err != nil || fmt.Sprint(operands) != fmt.Sprint(map[Register]Word{R1: 6, R2: 2}) {
+		t.Errorf("unexpected operands %v %v", operands, err)
+	}
+}
+
+func TestReads(t *testing.T) {
+	for _, test := range []struct {
+		instruction string
+		reads       []Register
+	}{
+		{"DADD R1, R1, R2", []Register{R1, R2}},
+		{"DADDI R1, R2, #3", []Register{R2}},
+		{"LD R2, 8(R1)", []Register{R1}},
+		{"SD 8(R1), R2", []Register{R1, R2}},
+		{"SD R2, 8(R1)", []Register{R2, R1}},
+		{"BEQ R1, R2, L", []Register{R1, R2}},
+		{"JALR R4", []Register{R4}},
+		{"JALR R3, R4", []Register{R4}},
+		{"DMULT R1, R2", []Register{R1, R2}},
+		{"MFHI R1", []Register{HI}},
+		{"BC1T L", []Register{FCC}},
+		{"J L", []Register{}},
+	} {
+		cpu, err := ParseCPUString("REGISTERS\nMEMORY\nCODE\nL: " + test.instruction + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reads := Reads(cpu.InstructionCache[0]); fmt.Sprint(reads) != fmt.Sprint(test.reads) {
+			t.Errorf("%s reads %v, expected %v", test.instruction, reads, test.reads)
+		}
+	}
+}
+
+func TestStallCauses(t *testing.T) {
+	cpu, err := ParseCPUString(`REGISTERS
+R1 6
+R2 2
+MEMORY
+CODE
+      DADD  R3, R1, R2
+      DSUB  R4, R3, R2
+      DIV.D F3, F1, F2
+      DIV.D F4, F1, F2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(200); err != nil {
+		t.Fatal(err)
+	}
+
+	causes := make(map[int]map[string]bool)
+	for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+		for inst, cause := range cpu.StallsInCycle(cycle) {
+			if causes[inst.Index] == nil {
+				causes[inst.Index] = make(map[string]bool)
+			}
+			causes[inst.Index][cause.Cause()] = true
+		}
+	}
+	if causes[1]["RAW on R3 from I#1"] == false {
+		t.Errorf("expected DSUB to stall for R3 from I#1, got %v", causes[1])
+	}
+	if causes[3]["structural on DIV from I#3"] == false {
+		t.Errorf("expected the second DIV.D to stall for the divider, got %v", causes[3])
+	}
+
+	// every (s) in the table is explained
+	for n, inst := range cpu.Instructions {
+		shown := 0
+		for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+			if cpu.timingCell(inst, cycle) == "(s)" {
+				shown++
+			}
+		}
+		if shown != len(inst.Stalls) {
+			t.Errorf("I#%d shows %d stalls, %d causes recorded", n+1, shown, len(inst.Stalls))
+		}
+	}
+	if table := cpu.RenderAnnotatedTiming(); strings.Contains(table, "I#2 RAW on R3 from I#1") == false {
+		t.Errorf("stall causes missing from\n%s", table)
+	}
+}
+
+func TestBranchStallCauses(t *testing.T) {
+	program := `REGISTERS
+R1 3
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      DADDI R2, R2, #1
+      DADDI R3, R3, #1
+`
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"flush", []Option{WithBranchPolicy(BranchPolicyFlush)}},
+		{"predict taken", []Option{WithBranchPolicy(BranchPolicyPredictTaken)}},
+		{"predict not taken", []Option{WithBranchPolicy(BranchPolicyPredictNotTaken)}},
+		{"dynamic", []Option{WithBranchPredictor(NewTwoBitPredictor(16))}},
+		{"delay slot", []Option{WithDelaySlots(1)}},
+	} {
+		cpu, err := ParseCPUString(program, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(test.name, err)
+		}
+
+		// every (s) is explained, a delay slot kept by a flush moves on and
+		// flushed instructions are not stalled
+		for n, inst := range cpu.Instructions {
+			shown := 0
+			for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+				if cpu.timingCell(inst, cycle) == "(s)" {
+					shown++
+				}
+				if _, ok := cpu.StallsInCycle(cycle)[inst]; ok && inst.CycleFlush != -1 {
+					t.Errorf("%s: flushed I#%d stalled in cycle %d", test.name, n+1, cycle)
+				}
+			}
+			if inst.CycleFlush == -1 && shown != len(inst.Stalls) {
+				t.Errorf("%s: I#%d shows %d stalls, %d causes recorded\n%s", test.name, n+1, shown, len(inst.Stalls), cpu.RenderAnnotatedTiming())
+			}
+		}
+		if table := cpu.RenderAnnotatedTiming(); strings.Contains(table, "I#2 RAW on R1 from I#1") == false {
+			t.Errorf("%s: stall causes missing from\n%s", test.name, table)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	cycles := make(map[BranchPolicy]int)
+	for _, policy := range []BranchPolicy{BranchPolicyFlush, BranchPolicyPredictNotTaken} {
+		cpu, err := ParseCPUString(CPU_TESTS["provided1"], WithBranchPolicy(policy), WithForwarding(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(500); err != nil {
+			t.Fatal(err)
+		}
+		s := cpu.Stats()
+		cycles[policy] = s.Cycles
+
+		// the loop runs twice
+		if s.Committed != 11 || s.Fetched != s.Committed+s.Flushed {
+			t.Errorf("%d committed of %d fetched, %d flushed", s.Committed, s.Fetched, s.Flushed)
+		}
+		if s.Branches != 2 || s.Taken != 1 || s.MemoryReads != 2 || s.MemoryWrites != 2 {
+			t.Errorf("unexpected counts\n%s", s)
+		}
+		if s.StallsByKind["RAW"] == 0 || s.StallCycles == 0 {
+			t.Errorf("expected RAW stalls\n%s", s)
+		}
+		// stalls of flushed instructions are not counted
+		stalled := 0
+		for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+			if len(cpu.StallsInCycle(cycle)) > 0 {
+				stalled++
+			}
+		}
+		if s.StallCycles != stalled {
+			t.Errorf("%d stall cycles, %d cycles with stalls", s.StallCycles, stalled)
+		}
+		if s.CPI != float64(s.Cycles)/float64(s.Committed) {
+			t.Errorf("CPI %f", s.CPI)
+		}
+		switch {
+		case policy == BranchPolicyPredictNotTaken && (s.Accuracy == nil || *s.Accuracy != 0.5 || s.BranchFlush != 1):
+			t.Errorf("expected the exit branch to be predicted\n%s", s)
+		case policy == BranchPolicyFlush && (s.Accuracy != nil || s.Mispredicted != 0 || s.BranchFlush != 2):
+			t.Errorf("expected every branch to flush, none predicted\n%s", s)
+		}
+		if j, err := s.JSON(); err != nil || strings.Contains(j, `"branch_flushes"`) == false {
+			t.Errorf("%s %v", j, err)
+		}
+		if policy == BranchPolicyFlush && strings.Contains(s.String(), "accuracy: n/a") == false {
+			t.Errorf("expected no accuracy under flush\n%s", s)
+		}
+	}
+	if cycles[BranchPolicyPredictNotTaken] >= cycles[BranchPolicyFlush] {
+		t.Errorf("expected prediction to save cycles: %v", cycles)
+	}
+
+	// a write to R0 is dropped, the instruction still commits
+	for _, opts := range [][]Option{
+		{},
+		{WithForwarding(true)},
+		{WithIssueWidth(2)},
+		{WithRenaming(40)},
+	} {
+		cpu, err := ParseCPUString(`REGISTERS
+R1 3
+MEMORY
+CODE
+      DADD  R0, R1, R1
+      DADD  R2, R0, R1
+`, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(100); err != nil {
+			t.Fatal(err)
+		}
+		if s := cpu.Stats(); s.Committed != 2 || cpu.Registers.Get(R0) != 0 || cpu.Registers.Get(R2) != 3 {
+			t.Errorf("unexpected result\n%s\n%s", s, cpu.Registers)
+		}
+	}
+}
+
+func TestBranchPredictors(t *testing.T) {
+	// a loop branch taken three times, then not taken, twice over
+	outcomes := []bool{true, true, true, false, true, true, true, false}
+	for _, test := range []struct {
+		name      string
+		predictor BranchPredictor
+		correct   int
+	}{
+		{"1-bit", NewOneBitPredictor(16), 4},
+		{"2-bit", NewTwoBitPredictor(16), 5},
+		{"gshare", NewGSharePredictor(4), 2},
+		{"tournament", NewTournamentPredictor(16, NewTwoBitPredictor(16), NewGSharePredictor(4)), 5},
+	} {
+		correct := 0
+		for _, taken := range outcomes {
+			if test.predictor.Predict(4) == taken {
+				correct++
+			}
+			test.predictor.Update(4, taken)
+		}
+		if correct != test.correct {
+			t.Errorf("%s predicted %d of %d, expected %d", test.name, correct, len(outcomes), test.correct)
+		}
+	}
+}
+
+func TestDynamicBranchPrediction(t *testing.T) {
+	program := `REGISTERS
+R1 6
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      DADDI R2, R2, #1
+`
+	accuracy := make(map[string]float64)
+	for name, opts := range map[string][]Option{
+		"not taken": {WithBranchPolicy(BranchPolicyPredictNotTaken)},
+		"2-bit":     {WithBranchPredictor(NewTwoBitPredictor(16))},
+	} {
+		cpu, err := ParseCPUString(program, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.Registers.Get(R1) != 0 || cpu.Registers.Get(R2) != 1 {
+			t.Fatalf("%s: unexpected result\n%s", name, cpu.Registers)
+		}
+		accuracy[name] = *cpu.Stats().Accuracy
+	}
+	if accuracy["2-bit"] <= accuracy["not taken"] {
+		t.Errorf("expected the 2-bit predictor to learn the loop: %v", accuracy)
+	}
+
+	if _, err := NewCPU(WithBranchPolicy(BranchPolicyPredictDynamic)); err == nil {
+		t.Error("expected an error without a predictor")
+	}
+}
+
+func TestBranchTargetBuffer(t *testing.T) {
+	program := `REGISTERS
+R1 4
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      DADDI R2, R2, #1
+`
+	cpu, err := ParseCPUString(program, WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(16, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R2) != 1 {
+		t.Fatalf("unexpected result\n%s", cpu.Registers)
+	}
+	// the first lookup misses, the branch then hits, also when fetched on
+	// the wrong path after falling through
+	s := cpu.Stats()
+	if s.BTBMisses != 1 || s.BTBHits != 4 || s.Mispredicted != 2 {
+		t.Errorf("unexpected BTB use\n%s", s)
+	}
+	// hits redirect fetch in IF1, nothing fetched after the branch is flushed
+	for _, i := range cpu.Instructions[3:6] {
+		if i.CycleFlush != -1 {
+			t.Errorf("I#%d flushed\n%s", i.Index+1, cpu.RenderTiming())
+		}
+	}
+
+	// entries are keyed on the address of the branch, not of its delay slot
+	cpu, err = ParseCPUString(program, WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(16, 2), WithDelaySlots(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cpu.BTB.Lookup(2); ok {
+		t.Error("expected no entry for the delay slot")
+	}
+	if target, ok := cpu.BTB.Lookup(1); ok == false || target != 0 {
+		t.Errorf("expected BNEZ to branch to Loop, got %v %v", target, ok)
+	}
+
+	b := NewBranchTargetBuffer(2, 2)
+	b.Insert(0, 10)
+	b.Insert(1, 11)
+	b.Lookup(0)
+	b.Insert(2, 12)
+	if _, ok := b.Lookup(1); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if target, ok := b.Lookup(0); ok == false || target != 10 {
+		t.Error("expected the most recently used entry to be kept")
+	}
+
+	if _, err := NewCPU(WithBTB(16, 2)); err == nil {
+		t.Error("expected an error for a BTB without prediction")
+	}
+	if _, err := NewCPU(WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(6, 4)); err == nil {
+		t.Error("expected an error for a partial set")
+	}
+}
+
+func TestReturnAddressStack(t *testing.T) {
+	program := `REGISTERS
+R1 3
+MEMORY
+CODE
+Loop: JAL   Sub
+      DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      J     End
+Sub:  DADDI R2, R2, #1
+      JR    R31
+End:  DADDI R3, R3, #1
+`
+	mispredicted := make(map[bool]int)
+	for _, ras := range []bool{false, true} {
+		opts := []Option{WithBranchPolicy(BranchPolicyPredictTaken)}
+		if ras {
+			opts = append(opts, WithRAS(4, RASOverwrite))
+		}
+		cpu, err := ParseCPUString(program, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(err)
+		}
+		if cpu.Registers.Get(R2) != 3 || cpu.Registers.Get(R3) != 1 {
+			t.Fatalf("unexpected result\n%s", cpu.Registers)
+		}
+		s := cpu.Stats()
+		mispredicted[ras] = s.Mispredicted
+		if ras && (s.RASHits != 3 || s.RASMisses != 0) {
+			t.Errorf("expected every return to be predicted\n%s", s)
+		}
+	}
+	// only the loop exit is mispredicted with the RAS
+	if mispredicted[false] != 4 || mispredicted[true] != 1 {
+		t.Errorf("unexpected mispredictions %v", mispredicted)
+	}
+
+	// a call fetched past a mispredicted branch is undone when it is flushed
+	cpu, err := ParseCPUString(`REGISTERS
+R1 2
+MEMORY
+CODE
+      J     Loop
+F:    JR    R31
+Loop: DADDI R1, R1, #-1
+      DADDI R3, R3, #1
+      DADDI R4, R4, #1
+      BNEZ  R1, Loop
+      JAL   F
+      DADDI R2, R2, #1
+`, WithBranchPolicy(BranchPolicyPredictNotTaken), WithRAS(4, RASOverwrite), WithForwarding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R2) != 1 || cpu.Stats().Flushed == 0 {
+		t.Fatalf("unexpected result\n%s", cpu.RenderTiming())
+	}
+	if len(cpu.RAS.addresses) != 0 || cpu.RAS.Hits != 1 {
+		t.Errorf("expected the return to pop the only call, stack %v, %d hits", cpu.RAS.addresses, cpu.RAS.Hits)
+	}
+
+	for _, test := range []struct {
+		overflow RASOverflow
+		popped   []Word
+	}{
+		{RASOverwrite, []Word{3, 2}},
+		{RASDiscard, []Word{2, 1}},
+	} {
+		r := NewReturnAddressStack(2, test.overflow)
+		r.Push(1)
+		r.Push(2)
+		r.Push(3)
+		popped := make([]Word, 0)
+		for address, ok := r.Pop(); ok; address, ok = r.Pop() {
+			popped = append(popped, address)
+		}
+		if fmt.Sprint(popped) != fmt.Sprint(test.popped) || r.Overflows != 1 || r.Misses != 1 {
+			t.Errorf("popped %v, expected %v", popped, test.popped)
+		}
+	}
+}
+
+func TestDelaySlots(t *testing.T) {
+	program := `REGISTERS
+R1 3
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      DADDI R2, R2, #1
+      JAL   Sub
+      DADDI R3, R3, #1
+      J     End
+      DADDI R4, R4, #1
+Sub:  JR    R31
+      DADDI R5, R5, #1
+End:  DADDI R6, R6, #1
+`
+	for _, test := range []struct {
+		name string
+		opts []Option
+	}{
+		{"flush", []Option{WithDelaySlots(1)}},
+		{"predict taken", []Option{WithDelaySlots(1), WithBranchPolicy(BranchPolicyPredictTaken)}},
+		{"predict not taken", []Option{WithDelaySlots(1), WithBranchPolicy(BranchPolicyPredictNotTaken)}},
+		{"btb and ras", []Option{WithDelaySlots(1), WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(16, 1), WithRAS(4, RASOverwrite)}},
+		{"five stages", []Option{WithDelaySlots(1), WithPipeline(FiveStagePipeline()...)}},
+	} {
+		cpu, err := ParseCPUString(program, test.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(test.name, err)
+		}
+		// every delay slot runs, the return address is past the slot of JAL
+		expected := map[Register]Word{R1: 0, R2: 3, R3: 1, R4: 1, R5: 1, R6: 1, R31: 5}
+		for r, v := range expected {
+			if cpu.Registers.Get(r) != v {
+				t.Errorf("%s: %s = %d, expected %d", test.name, r, cpu.Registers.Get(r), v)
+			}
+		}
+	}
+
+	// with two slots both instructions after the branch run every iteration
+	cpu, err := ParseCPUString(`REGISTERS
+R1 3
+MEMORY
+CODE
+Loop: DADDI R1, R1, #-1
+      BNEZ  R1, Loop
+      DADDI R2, R2, #1
+      DADDI R3, R3, #1
+      DADDI R4, R4, #1
+`, WithDelaySlots(2), WithBranchPolicy(BranchPolicyPredictTaken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R2) != 3 || cpu.Registers.Get(R3) != 3 || cpu.Registers.Get(R4) != 1 {
+		t.Errorf("unexpected result\n%s", cpu.Registers)
+	}
+}
+
+func TestTomasulo(t *testing.T) {
+	// the same results as the pipeline
+	for name, program := range CPU_TESTS {
+		pipeline, err := ParseCPUString(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pipeline.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		cpu, err := ParseCPUString(program, WithTomasulo(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		if cpu.String() != pipeline.String() {
+			t.Errorf("%s: %s\nexpected\n%s", name, cpu, pipeline)
+		}
+	}
+
+	cpu, err := ParseCPUString(`REGISTERS
+R1 16
+R2 32
+MEMORY
+16 4611686018427387904
+24 4613937818241073152
+CODE
+      L.D   F6, 8(R1)
+      L.D   F2, 0(R1)
+      MUL.D F0, F2, F4
+      SUB.D F8, F6, F2
+      DIV.D F10, F0, F6
+      ADD.D F6, F8, F2
+      S.D   F6, 0(R2)
+`, WithTomasulo(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	// ADD.D renames F6, DIV.D still reads the loaded 3.0
+	if cpu.Registers.Get(F6).Float() != 3 || cpu.Ram.Word(32) != FloatWord(3) {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	mul, sub, div, add := cpu.Instructions[2], cpu.Instructions[3], cpu.Instructions[4], cpu.Instructions[5]
+	if sub.Stages["WR"] >= mul.Stages["WR"] || add.Stages["WR"] >= div.Stages["WR"] {
+		t.Errorf("expected results out of order\n%s", cpu.RenderTiming())
+	}
+	// MUL.D issues in cycle 3, waits two cycles for F2 and executes from
+	// cycle 6 to 12
+	if mul.Stages["IS"] != 3 || mul.Stages["EX"] != 12 || mul.Stages["WR"] != 13 || len(mul.Stalls) != 2 {
+		t.Errorf("unexpected MUL.D timing %v\n%s", mul.Stages, cpu.RenderAnnotatedTiming())
+	}
+	for _, cycle := range []int{4, 5} {
+		if c := mul.Stalls[cycle]; c == nil || c.Kind != HazardRAW || c.Register != F2 || c.Producer != cpu.Instructions[1] {
+			t.Errorf("expected MUL.D to wait for F2 in cycle %d\n%s", cycle, cpu.RenderAnnotatedTiming())
+		}
+	}
+	if cpu.RenderTiming() == "" || strings.Contains(cpu.RenderTiming(), "IS") == false {
+		t.Errorf("expected issue cycles in\n%s", cpu.RenderTiming())
+	}
+
+	// writes to R0 are dropped, with or without a reorder buffer
+	for _, rob := range []int{0, 8} {
+		opts := []Option{WithTomasulo(nil)}
+		if rob > 0 {
+			opts = append(opts, WithReorderBuffer(rob))
+		}
+		cpu, err := ParseCPUString("REGISTERS\nR1 3\nMEMORY\nCODE\n      DADD  R0, R1, R1\n      DADD  R2, R0, R1\n", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(100); err != nil {
+			t.Fatal(rob, err)
+		}
+		if cpu.Registers.Get(R0) != 0 || cpu.Registers.Get(R2) != 3 || cpu.Stats().Committed != 2 {
+			t.Errorf("unexpected result\n%s", cpu.Registers)
+		}
+	}
+
+	// the classes not given keep their default stations
+	cpu, err = ParseCPUString(CPU_TESTS["provided1"], WithTomasulo(map[string]int{"M": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stations := len(cpu.Engine.(*Tomasulo).Stations); stations != 14 {
+		t.Errorf("expected 14 reservation stations, got %d", stations)
+	}
+
+	for _, opts := range [][]Option{
+		{WithTomasulo(map[string]int{"X": 1})},
+		{WithTomasulo(map[string]int{"EX": 0})},
+		{WithTomasulo(nil), WithBranchPolicy(BranchPolicyPredictTaken)},
+		{WithTomasulo(nil), WithDelaySlots(1)},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	// the same results as the pipeline, predicting or not
+	for _, policy := range []Option{
+		WithBranchPolicy(BranchPolicyFlush),
+		WithBranchPolicy(BranchPolicyPredictTaken),
+		WithBranchPolicy(BranchPolicyPredictNotTaken),
+		WithBranchPredictor(NewTwoBitPredictor(16)),
+	} {
+		for name, program := range CPU_TESTS {
+			pipeline, err := ParseCPUString(program)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pipeline.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			cpu, err := ParseCPUString(program, WithTomasulo(nil), WithReorderBuffer(8), policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cpu.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if cpu.String() != pipeline.String() {
+				t.Errorf("%s: %s\nexpected\n%s", name, cpu, pipeline)
+			}
+		}
+	}
+
+	// the load after the loop runs speculatively while the loop is taken,
+	// its address is only valid once R2 has been counted down
+	program := `REGISTERS
+R1 3
+R2 3000008
+R3 800
+MEMORY
+CODE
+Loop: MUL.D F2, F4, F6
+      DADDI R1, R1, #-1
+      DADDI R2, R2, #-1000000
+      SD    R1, 0(R3)
+      BNEZ  R1, Loop
+      LD    R4, 0(R2)
+      DADDI R5, R4, 1
+`
+	cpu, err := ParseCPUString(program, WithTomasulo(nil), WithReorderBuffer(6), WithBranchPolicy(BranchPolicyPredictNotTaken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err, "\n", cpu.RenderTiming())
+	}
+	if cpu.Registers.Get(R5) != 1 || cpu.Registers.Get(R1) != 0 {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	if stats := cpu.Stats(); stats.Flushed == 0 || stats.Mispredicted != 2 {
+		t.Errorf("expected squashed instructions after the taken branches: %+v\n%s", stats, cpu.RenderTiming())
+	}
+	// commit in order
+	committed := 0
+	for _, i := range cpu.Instructions {
+		if i.CycleFlush != -1 {
+			continue
+		}
+		if i.Stages["CM"] <= committed {
+			t.Errorf("I#%d committed out of order\n%s", i.Index+1, cpu.RenderTiming())
+		}
+		committed = i.Stages["CM"]
+	}
+	rob := cpu.Engine.(*Tomasulo).ROB
+	if len(rob.Occupancy) != cpu.Cycle {
+		t.Errorf("expected the occupancy of %d cycles, got %v", cpu.Cycle, rob.Occupancy)
+	}
+	for _, occupancy := range rob.Occupancy {
+		if occupancy > 6 {
+			t.Errorf("ROB overfilled: %v", rob.Occupancy)
+		}
+	}
+	if strings.Contains(rob.RenderOccupancy(), "6/6 ######") == false {
+		t.Errorf("expected the ROB to fill up\n%s", rob.RenderOccupancy())
+	}
+
+	for _, opts := range [][]Option{
+		{WithReorderBuffer(8)},
+		{WithTomasulo(nil), WithReorderBuffer(0)},
+		{WithTomasulo(nil), WithReorderBuffer(8), WithDelaySlots(1)},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Error("expected an error")
+		}
+	}
+
+	// the call issued past the mispredicted branch is undone
+	cpu, err = ParseCPUString(`REGISTERS
+R1 1
+MEMORY
+CODE
+      BNEZ  R1, Skip
+      JAL   Sub
+Skip: DADDI R2, R2, #1
+      J     End
+Sub:  DADDI R4, R4, #1
+End:  DADDI R3, R3, #1
+`, WithTomasulo(nil), WithReorderBuffer(8), WithBranchPolicy(BranchPolicyPredictNotTaken), WithRAS(4, RASOverwrite))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R2) != 1 || cpu.Registers.Get(R3) != 1 || cpu.Registers.Get(R4) != 0 || cpu.Registers.Get(R31) != 0 {
+		t.Errorf("unexpected result\n%s", cpu.Registers)
+	}
+	if len(cpu.RAS.addresses) != 0 {
+		t.Errorf("expected an empty return address stack, got %v", cpu.RAS.addresses)
+	}
+}
+
+func TestScoreboard(t *testing.T) {
+	// the same results as the pipeline
+	for name, program := range CPU_TESTS {
+		pipeline, err := ParseCPUString(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pipeline.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		cpu, err := ParseCPUString(program, WithScoreboard(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cpu.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		if cpu.String() != pipeline.String() {
+			t.Errorf("%s: %s\nexpected\n%s", name, cpu, pipeline)
+		}
+	}
+
+	cpu, err := ParseCPUString(`REGISTERS
+R1 16
+R2 32
+MEMORY
+16 4611686018427387904
+24 4613937818241073152
+CODE
+      L.D   F6, 8(R1)
+      L.D   F2, 0(R1)
+      MUL.D F0, F2, F4
+      SUB.D F8, F6, F2
+      DIV.D F10, F0, F6
+      ADD.D F6, F8, F2
+      S.D   F6, 0(R2)
+      MUL.D F0, F2, F2
+`, WithScoreboard(nil), WithLatency("A", 2), WithLatency("M", 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(F6).Float() != 3 || cpu.Ram.Word(32) != FloatWord(3) || cpu.Registers.Get(F0).Float() != 4 {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	add, mul := cpu.Instructions[5], cpu.Instructions[7]
+	// ADD.D waits for DIV.D to read the old F6
+	if c := add.Stalls[add.Stages["WR"]-1]; c == nil || c.Kind != HazardWAR || c.Register != F6 {
+		t.Errorf("expected a WAR stall on F6\n%s", cpu.RenderAnnotatedTiming())
+	}
+	// the second MUL.D waits for the first to write F0
+	if c := mul.Stalls[mul.Stages["IS"]-1]; c == nil || c.Kind != HazardWAW || c.Register != F0 {
+		t.Errorf("expected a WAW stall on F0\n%s", cpu.RenderAnnotatedTiming())
+	}
+	table := cpu.Engine.(*Scoreboard).RenderTable()
+	if strings.Contains(table, "Issue") == false || strings.Count(table, "\n") != len(cpu.Instructions)+1 {
+		t.Errorf("unexpected table\n%s", table)
+	}
+
+	// writes to R0 are dropped
+	cpu, err = ParseCPUString("REGISTERS\nR1 3\nMEMORY\nCODE\n      DADD  R0, R1, R1\n      DADD  R2, R0, R1\n", WithScoreboard(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R0) != 0 || cpu.Registers.Get(R2) != 3 || cpu.Stats().Committed != 2 {
+		t.Errorf("unexpected result\n%s", cpu.Registers)
+	}
+	for _, cause := range cpu.Instructions[1].Stalls {
+		if cause.Kind == HazardRAW {
+			t.Errorf("unexpected stall reading R0: %s", cause.Cause())
+		}
+	}
+
+	// the classes not given keep their default units
+	cpu, err = ParseCPUString(CPU_TESTS["provided1"], WithScoreboard(map[string]int{"M": 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if units := len(cpu.Engine.(*Scoreboard).Units); units != 4 {
+		t.Errorf("expected 4 functional units, got %d", units)
+	}
+
+	for _, opts := range [][]Option{
+		{WithScoreboard(map[string]int{"X": 1})},
+		{WithScoreboard(map[string]int{"EX": 0})},
+		{WithScoreboard(nil), WithTomasulo(nil)},
+		{WithScoreboard(nil), WithReorderBuffer(8)},
+		{WithScoreboard(nil), WithBranchPolicy(BranchPolicyPredictTaken)},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+func TestSuperscalar(t *testing.T) {
+	// the same results as the scalar pipeline
+	for name, program := range CPU_TESTS {
+		scalar, err := ParseCPUString(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := scalar.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, opts := range [][]Option{
+			{WithIssueWidth(2)},
+			{WithIssueWidth(2), WithForwarding(true), WithBranchPolicy(BranchPolicyPredictNotTaken)},
+			{WithIssueWidth(3), WithForwarding(true), WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(16, 2)},
+			{WithIssueWidth(2), WithForwarding(true), WithPipeline(FiveStagePipeline()...)},
+		} {
+			cpu, err := ParseCPUString(program, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cpu.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if cpu.String() != scalar.String() {
+				t.Errorf("%s: %s\nexpected\n%s", name, cpu, scalar)
+			}
+		}
+	}
+
+	program := `REGISTERS
+R1 8
+MEMORY
+CODE
+      DADDI R2, R0, #1
+      DADDI R3, R0, #2
+      LD    R4, 0(R1)
+      LD    R5, 8(R1)
+      DADDI R6, R2, #3
+      DADDI R7, R6, #4
+`
+	cpu, err := ParseCPUString(program, WithIssueWidth(2), WithForwarding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R7) != 8 {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	i := cpu.Instructions
+	// the two DADDIs are fetched and issued together
+	if i[0].Stages["IF1"] != 1 || i[1].Stages["IF1"] != 1 || i[0].Stages["ID"] != i[1].Stages["ID"] {
+		t.Errorf("expected I#1 and I#2 to issue together\n%s", cpu.RenderTiming())
+	}
+	// one memory access per bundle
+	if c := i[3].Stalls[i[2].Stages["ID"]]; c == nil || c.Kind != HazardStructural || c.Unit != "MEM" || c.Producer != i[2] {
+		t.Errorf("expected the second LD to wait for the first\n%s", cpu.RenderAnnotatedTiming())
+	}
+	// no dependencies within a bundle
+	if i[6-1].Stages["ID"] == i[6-2].Stages["ID"] {
+		t.Errorf("expected I#6 to issue after I#5\n%s", cpu.RenderAnnotatedTiming())
+	}
+	scalar, err := ParseCPUString(program, WithForwarding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scalar.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Cycle >= scalar.Cycle {
+		t.Errorf("expected fewer cycles than %d, got %d\n%s", scalar.Cycle, cpu.Cycle, cpu.RenderTiming())
+	}
+
+	for _, opts := range [][]Option{
+		{WithIssueWidth(0)},
+		{WithIssueWidth(2), WithTomasulo(nil)},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+func TestRenaming(t *testing.T) {
+	// the same results with renaming, and every physical register freed
+	for name, program := range CPU_TESTS {
+		scalar, err := ParseCPUString(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := scalar.Run(1000); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, opts := range [][]Option{
+			{WithRenaming(64)},
+			{WithRenaming(33), WithForwarding(true), WithBranchPolicy(BranchPolicyPredictNotTaken)},
+			{WithRenaming(40), WithIssueWidth(2), WithForwarding(true), WithBranchPolicy(BranchPolicyPredictTaken), WithBTB(16, 2)},
+			{WithRenaming(40), WithForwarding(true), WithPipeline(FiveStagePipeline()...)},
+		} {
+			cpu, err := ParseCPUString(program, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cpu.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if cpu.String() != scalar.String() {
+				t.Errorf("%s: %s\nexpected\n%s", name, cpu, scalar)
+			}
+			if cpu.Renaming.Available() != cpu.Renaming.Size-32 {
+				t.Errorf("%s: physical registers not freed, %s", name, cpu.Renaming)
+			}
+		}
+	}
+
+	program := `REGISTERS
+R2 3
+R3 4
+MEMORY
+CODE
+      DMUL  R1, R2, R3
+      DADDI R1, R0, #5
+      DADDI R4, R1, #1
+      DADDI R2, R0, #7
+`
+	plain, err := ParseCPUString(program, WithForwarding(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	cpu, err := ParseCPUString(program, WithForwarding(true), WithRenaming(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.String() != plain.String() || cpu.Registers.Get(R1) != 5 || cpu.Registers.Get(R4) != 6 {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	// without renaming the second write of R1 waits for the multiply
+	if stalledBy(plain.Instructions[1], HazardWAW, "") == false {
+		t.Errorf("expected a WAW stall\n%s", plain.RenderAnnotatedTiming())
+	}
+	for _, c := range cpu.Instructions[1].Stalls {
+		t.Errorf("unexpected stall %s\n%s", c.Cause(), cpu.RenderAnnotatedTiming())
+	}
+	if cpu.Cycle >= plain.Cycle {
+		t.Errorf("expected fewer cycles than %d, got %d", plain.Cycle, cpu.Cycle)
+	}
+	// P32 is freed once the multiply has written it, after the DADDI
+	// replacing it has written back
+	maps := cpu.Renaming.RenderMaps()
+	for _, line := range []string{
+		"      R1    R2    R4    free",
+		"c#4   P32   P2    P4    31",
+		"c#5   P33   P2    P4    30",
+		"c#12  P33   P35   P34   30",
+		"c#15  P33   P35   P34   32",
+	} {
+		if strings.Contains(maps, line+"\n") == false {
+			t.Errorf("expected %q in\n%s", line, maps)
+		}
+	}
+
+	// with two spare physical registers the third write waits for one
+	cpu, err = ParseCPUString(program, WithForwarding(true), WithRenaming(34))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(1000); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.String() != plain.String() || stalledBy(cpu.Instructions[2], HazardStructural, "free list") == false {
+		t.Errorf("expected I#3 to wait for a free register\n%s", cpu.RenderAnnotatedTiming())
+	}
+
+	for _, opts := range [][]Option{
+		{WithRenaming(32)},
+		{WithRenaming(64), WithTomasulo(nil)},
+	} {
+		if _, err := NewCPU(opts...); err == nil {
+			t.Error("expected an error")
+		}
+	}
+}
+
+// stalledBy reports whether i stalled for a hazard of the given kind, and
+// on the given unit if not empty
+func stalledBy(i *ExecutedInstruction, kind HazardKind, unit string) bool {
+	for _, c := range i.Stalls {
+		if c.Kind == kind && (unit == "" || c.Unit == unit) {
+			return true
+		}
+	}
+	return false
+}
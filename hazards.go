@@ -0,0 +1,317 @@
+package mips
+
+import (
+	"fmt"
+)
+
+// Kinds of hazard told apart by the hazard detection unit. WAR hazards are
+// only reported by the scoreboard, the pipelines read operands in order.
+type HazardKind int
+
+const (
+	HazardRAW HazardKind = iota + 1
+	HazardWAR
+	HazardWAW
+	HazardStructural
+	HazardControl
+)
+
+func (k HazardKind) String() string {
+	switch k {
+	case HazardRAW:
+		return "RAW"
+	case HazardWAR:
+		return "WAR"
+	case HazardWAW:
+		return "WAW"
+	case HazardStructural:
+		return "structural"
+	case HazardControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// Hazard is a hazard found by the hazard detection unit. Data and
+// structural hazards are returned as errors by the stage that has to stall.
+type Hazard struct {
+	Kind        HazardKind
+	Instruction *ExecutedInstruction // the instruction held up, or the branch
+	Register    Register             // data hazards
+	Producer    *ExecutedInstruction // the instruction waited for, if any
+	Unit        string               // structural hazards
+	Stage       string
+	Cycle       int
+}
+
+func (h *Hazard) Error() string {
+	switch h.Kind {
+	case HazardStructural:
+		return fmt.Sprintf("%s Hazard on unit %s", h.Kind, h.Unit)
+	case HazardControl:
+		return fmt.Sprintf("%s Hazard", h.Kind)
+	}
+	return fmt.Sprintf("%s Hazard on %s", h.Kind, h.Register)
+}
+
+// Is matches the sentinel errors, so errors.Is(err, RAWHazard) keeps working
+func (h *Hazard) Is(target error) bool {
+	switch h.Kind {
+	case HazardRAW:
+		return target == RAWHazard
+	case HazardWAW:
+		return target == WAWHazard
+	case HazardStructural:
+		return target == Stall
+	}
+	return false
+}
+
+// reader is implemented by instructions reading registers that are not
+// among their operands, e.g. MFHI
+type reader interface {
+	Reads() []Register
+}
+
+// Reads returns the registers an instruction reads. Unless it says
+// otherwise these are its register operands, less a destination it writes.
+func Reads(i Instruction) []Register {
+	if e, ok := i.(*ExecutedInstruction); ok {
+		i = e.Instruction
+	}
+	if r, ok := i.(reader); ok {
+		return r.Reads()
+	}
+	result := make([]Register, 0)
+	add := func(o Operand) {
+		if o.Type == operandTypeNormal || o.Type == operandTypeOffset {
+			result = append(result, o.Register)
+		}
+	}
+	d := i.Destination()
+	written := false
+	for _, w := range i.Writes() {
+		written = written || (d.Type == operandTypeNormal && w == d.Register)
+	}
+	if written == false {
+		add(d)
+	}
+	add(i.OperandA())
+	add(i.OperandB())
+	return result
+}
+
+// HazardUnit detects hazards and decides stalls, so that instructions only
+// implement their semantics. Instructions declare the registers they read
+// and write, the unit checks them as they are decoded, reserves their
+// destinations and finds the producer to forward each operand from.
+type HazardUnit struct {
+	cpu      *CPU
+	Detected []*Hazard // hazards found in the current cycle
+}
+
+func newHazardUnit(cpu *CPU) *HazardUnit {
+	return &HazardUnit{cpu: cpu}
+}
+
+// Decode checks an instruction about to read its operands. It returns the
+// values it read, or a hazard if the instruction must wait in decode.
+func (h *HazardUnit) Decode(i *ExecutedInstruction) (map[Register]Word, error) {
+	if err := h.pair(i); err != nil {
+		return nil, err
+	}
+	// a functional unit could otherwise write a destination after it,
+	// unless the destination is renamed
+	renaming := h.cpu.Renaming
+	for _, r := range i.Writes() {
+		if renaming.renames(r) {
+			continue
+		}
+		if producer := h.cpu.unitPendingWrite(r); producer != nil {
+			return nil, &Hazard{Kind: HazardWAW, Instruction: i, Register: r, Producer: producer}
+		}
+	}
+	operands := make(map[Register]Word)
+	for _, r := range Reads(i) {
+		value, err := h.Read(i, r)
+		if err != nil {
+			return nil, err
+		}
+		operands[r] = value
+	}
+	if renaming != nil && len(renaming.destinations(i)) > renaming.Available() {
+		return nil, &Hazard{Kind: HazardStructural, Instruction: i, Unit: "free list"}
+	}
+	return operands, nil
+}
+
+// pair checks that an instruction may issue along with the older ones
+// decoded in the same stage this cycle: one memory access and one branch
+// per bundle, and none depending on another
+func (h *HazardUnit) pair(i *ExecutedInstruction) error {
+	for _, older := range i.Stage.Slots() {
+		if older.Index >= i.Index {
+			break
+		}
+		_, access := i.Instruction.(accessor)
+		_, olderAccess := older.Instruction.(accessor)
+		_, branch := i.Instruction.(brancher)
+		_, olderBranch := older.Instruction.(brancher)
+		switch {
+		case access && olderAccess:
+			return &Hazard{Kind: HazardStructural, Instruction: i, Unit: "MEM", Producer: older}
+		case branch && olderBranch:
+			return &Hazard{Kind: HazardStructural, Instruction: i, Unit: "branch", Producer: older}
+		}
+		for _, w := range older.Writes() {
+			if readsRegister(i, w) {
+				return &Hazard{Kind: HazardRAW, Instruction: i, Register: w, Producer: older}
+			}
+			for _, r := range i.Writes() {
+				if r == w && h.cpu.Renaming.renames(r) == false {
+					return &Hazard{Kind: HazardWAW, Instruction: i, Register: r, Producer: older}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Reserve marks the destinations of a decoded instruction as pending until
+// its writeback, and renames them
+func (h *HazardUnit) Reserve(i *ExecutedInstruction) {
+	for _, r := range i.Writes() {
+		i.Acquire(r)
+	}
+	if h.cpu.Renaming != nil {
+		h.cpu.Renaming.rename(i)
+	}
+}
+
+// Read returns the value of r for an instruction reading it in decode. While
+// an instruction in flight is yet to write r the value is forwarded from
+// where that instruction is if the path from there is enabled, otherwise
+// the reader has to wait (RAW hazard). Renamed registers are read from the
+// physical register they are mapped to, once written. R0 always reads 0.
+func (h *HazardUnit) Read(i *ExecutedInstruction, r Register) (Word, error) {
+	if r == R0 {
+		return 0, nil
+	}
+	producer, path := h.cpu.Pipeline.producer(r)
+	if h.cpu.Renaming.renames(r) {
+		value, writer := h.cpu.Renaming.read(r)
+		if writer == nil {
+			return value, nil
+		}
+		producer, path = writer, h.cpu.Pipeline.pathOf(writer)
+	}
+	if producer == nil {
+		return h.cpu.Registers.Get(r), nil
+	}
+	value, ok := producer.Result(r)
+	if ok == false || h.cpu.Forwarding&path == 0 {
+		return 0, &Hazard{Kind: HazardRAW, Instruction: i, Register: r, Producer: producer}
+	}
+	return value, nil
+}
+
+// Dispatch checks that the functional unit can accept an instruction this
+// cycle
+func (h *HazardUnit) Dispatch(i *ExecutedInstruction, u *FunctionalUnit) error {
+	if u.accepts() {
+		return nil
+	}
+	return &Hazard{Kind: HazardStructural, Instruction: i, Unit: u.Name, Producer: u.blocker()}
+}
+
+// record notes a hazard found by a stage this cycle, control hazards are
+// the branches stalling or flushing the stages before them
+func (h *HazardUnit) record(stage PipelineStage, err error) {
+	hazard, ok := err.(*Hazard)
+	if ok == false {
+		hazard = &Hazard{Kind: HazardControl, Instruction: stage.GetInstruction()}
+		switch err {
+		case RAWHazard:
+			hazard.Kind = HazardRAW
+		case WAWHazard:
+			hazard.Kind = HazardWAW
+		case Stall:
+			hazard.Kind = HazardStructural
+		}
+	}
+	if hazard.Instruction == nil {
+		hazard.Instruction = stage.GetInstruction()
+	}
+	hazard.Stage = stage.String()
+	hazard.Cycle = h.cpu.Cycle
+	h.Detected = append(h.Detected, hazard)
+}
+
+// attribute records the cause of the stall of every instruction that did
+// not enter a stage this cycle. Those in or before the stage that stopped
+// the pipeline wait for its hazard, those held before a branch resolving or
+// flushing wait for the branch, others are still held by the previous
+// cycle's stall. Flushed instructions are not stalled.
+func (h *HazardUnit) attribute() {
+	p := h.cpu.Pipeline
+	cycle := h.cpu.Cycle
+
+	stopped, stoppedAt := (*Hazard)(nil), -1
+	control, controlAt := (*Hazard)(nil), -1
+	for _, hazard := range h.Detected {
+		switch at := p.stageIndex(hazard.Stage); {
+		case hazard.Kind != HazardControl:
+			stopped, stoppedAt = hazard, at
+		case at > controlAt:
+			control, controlAt = hazard, at
+		}
+	}
+
+	for _, i := range p.ActiveInstructions() {
+		if _, moved := i.Cycles[cycle]; moved || i.CycleStart == cycle || i.CycleFlush != -1 {
+			continue
+		}
+		var cause *Hazard
+		switch u := h.cpu.unitHolding(i); {
+		case u != nil:
+			// finished, waiting for an older instruction to leave EX first
+			cause = &Hazard{Kind: HazardStructural, Instruction: i, Unit: u.Name, Producer: u.ahead(i), Stage: i.Stage.String(), Cycle: cycle}
+		case stopped != nil && p.stageIndex(i.Stage.String()) <= stoppedAt:
+			cause = stopped
+		case indexOfInstruction(i.Stage.Leaving(), i) != -1:
+			// a delay slot kept by a flush moves on without being stepped
+		case control != nil && p.stageIndex(i.Stage.String()) < controlAt:
+			cause = control
+		default:
+			cause = i.Stalls[cycle-1]
+		}
+		if cause != nil {
+			i.Stalls[cycle] = cause
+		}
+	}
+}
+
+// Cause describes the hazard as the reason of a stall, e.g. "RAW on R3 from
+// I#1"
+func (h *Hazard) Cause() string {
+	switch {
+	case h.Kind == HazardControl:
+		return fmt.Sprintf("branch resolving I#%d", h.Instruction.Index+1)
+	case h.Kind == HazardStructural && h.Producer != nil:
+		return fmt.Sprintf("structural on %s from I#%d", h.Unit, h.Producer.Index+1)
+	case h.Kind == HazardStructural:
+		return fmt.Sprintf("structural on %s", h.Unit)
+	case h.Producer != nil:
+		return fmt.Sprintf("%s on %s from I#%d", h.Kind, h.Register, h.Producer.Index+1)
+	}
+	return fmt.Sprintf("%s on %s", h.Kind, h.Register)
+}
+
+func readsRegister(i Instruction, r Register) bool {
+	for _, read := range Reads(i) {
+		if read == r {
+			return true
+		}
+	}
+	return false
+}
@@ -3,10 +3,13 @@ package mips
 import (
 	"errors"
 	"fmt"
+	"math/bits"
+	"reflect"
 )
 
 var (
 	RAWHazard       = errors.New("RAW Hazard")
+	WAWHazard       = errors.New("WAW Hazard")
 	Stall           = errors.New("Stall")
 	FlushPipeline   = errors.New("Pipeline should flush")
 	BranchResolving = errors.New("Branch is resolving")
@@ -27,11 +30,16 @@ type Instruction interface {
 	OperandB() Operand
 	SetOperandB(o Operand)
 	Flush()
+	Unit() string       // name of the functional unit that executes the instruction
+	Writes() []Register // registers the instruction writes
+	Result(register Register) (Word, bool)
+	Acquire(register Register)
 
 	IF1() error
 	IF2() error
 	IF3() error
 	ID() error
+	Resolve() error // resolves a branch, in ID unless the pipeline says otherwise
 	EX() error
 	MEM1() error
 	MEM2() error
@@ -59,14 +67,20 @@ type Operand struct {
 type Label string
 
 type instruction struct {
-	cpu                 *CPU
-	label               Label
-	text                string
-	opcode              string
-	destination         Operand
-	operandA            Operand
-	operandB            Operand
-	destinationAcquired bool
+	cpu         *CPU
+	label       Label
+	text        string
+	opcode      string
+	destination Operand
+	operandA    Operand
+	operandB    Operand
+	acquired    []Register // registers locked until writeback
+	results     []result   // values produced, written to the register file in WB
+}
+
+type result struct {
+	register Register
+	value    Word
 }
 
 func (op Operand) String() string {
@@ -88,15 +102,10 @@ func (op Operand) Value(cpu *CPU) (value Word, err error) {
 	case operandTypeImmediate:
 		value = Word(op.Offset)
 	case operandTypeNormal:
-		if cpu.Registers.Locked(op.Register) {
-			return value, RAWHazard
-		}
-		value = cpu.Registers.Get(op.Register)
+		value, err = cpu.readRegister(op.Register)
 	case operandTypeOffset:
-		if cpu.Registers.Locked(op.Register) {
-			return value, RAWHazard
-		}
-		value = cpu.Registers.Get(op.Register) + Word(op.Offset)
+		value, err = cpu.readRegister(op.Register)
+		value += Word(op.Offset)
 	case operandTypeLabel:
 		value = Word(cpu.Labels[Label(op.text)])
 	default:
@@ -113,15 +122,127 @@ func NewInstruction(opcode string) (i Instruction, err error) {
 
 	switch opcode {
 	case "LD":
-		i = new(LD)
+		i = &LD{newLoadStore(8, true)}
+	case "LW":
+		i = &LW{LD{newLoadStore(4, true)}}
+	case "LWU":
+		i = &LWU{LD{newLoadStore(4, false)}}
+	case "LH":
+		i = &LH{LD{newLoadStore(2, true)}}
+	case "LHU":
+		i = &LHU{LD{newLoadStore(2, false)}}
+	case "LB":
+		i = &LB{LD{newLoadStore(1, true)}}
+	case "LBU":
+		i = &LBU{LD{newLoadStore(1, false)}}
 	case "SD":
-		i = new(SD)
+		i = &SD{newLoadStore(8, false)}
+	case "SW":
+		i = &SW{SD{newLoadStore(4, false)}}
+	case "SH":
+		i = &SH{SD{newLoadStore(2, false)}}
+	case "SB":
+		i = &SB{SD{newLoadStore(1, false)}}
 	case "DADD":
 		i = new(DADD)
 	case "DADDI":
 		i = new(DADDI)
+	case "DADDU":
+		i = new(DADDU)
+	case "DADDIU":
+		i = new(DADDIU)
+	case "DSUB":
+		i = new(DSUB)
+	case "DSUBU":
+		i = new(DSUBU)
+	case "AND":
+		i = new(AND)
+	case "ANDI":
+		i = new(ANDI)
+	case "OR":
+		i = new(OR)
+	case "ORI":
+		i = new(ORI)
+	case "XOR":
+		i = new(XOR)
+	case "XORI":
+		i = new(XORI)
+	case "NOR":
+		i = new(NOR)
+	case "SLT":
+		i = new(SLT)
+	case "SLTI":
+		i = new(SLTI)
+	case "SLTU":
+		i = new(SLTU)
+	case "SLTIU":
+		i = new(SLTIU)
+	case "LUI":
+		i = new(LUI)
+	case "DSLL":
+		i = new(DSLL)
+	case "DSRL":
+		i = new(DSRL)
+	case "DSRA":
+		i = new(DSRA)
+	case "DSLLV":
+		i = new(DSLLV)
+	case "DSRLV":
+		i = new(DSRLV)
+	case "DSRAV":
+		i = new(DSRAV)
+	case "DSLL32":
+		i = new(DSLL32)
+	case "DSRL32":
+		i = new(DSRL32)
+	case "DSRA32":
+		i = new(DSRA32)
+	case "DMUL":
+		i = new(DMUL)
+	case "DMULT":
+		i = new(DMULT)
+	case "DDIV":
+		i = new(DDIV)
+	case "DDIVU":
+		i = new(DDIVU)
+	case "MFHI":
+		i = new(MFHI)
+	case "MFLO":
+		i = new(MFLO)
+	case "L.D":
+		i = &L_D{LD{newLoadStore(8, false)}}
+	case "S.D":
+		i = &S_D{SD{newLoadStore(8, false)}}
+	case "ADD.D":
+		i = new(ADD_D)
+	case "SUB.D":
+		i = new(SUB_D)
+	case "MUL.D":
+		i = new(MUL_D)
+	case "DIV.D":
+		i = new(DIV_D)
+	case "C.LT.D":
+		i = new(C_LT_D)
+	case "BC1T":
+		i = new(BC1T)
+	case "BC1F":
+		i = new(BC1F)
+	case "BEQ":
+		i = new(BEQ)
+	case "BNE":
+		i = new(BNE)
+	case "BEQZ":
+		i = new(BEQZ)
 	case "BNEZ":
 		i = new(BNEZ)
+	case "J":
+		i = new(J)
+	case "JAL":
+		i = new(JAL)
+	case "JR":
+		i = new(JR)
+	case "JALR":
+		i = new(JALR)
 	default:
 		return nil, errors.New(fmt.Sprintf("Invalid opcode. %s", opcode))
 	}
@@ -129,8 +250,20 @@ func NewInstruction(opcode string) (i Instruction, err error) {
 	return
 }
 
+// copyInstruction returns a shallow copy of a decoded instruction so each
+// dynamic instance in the pipeline has its own operand values and state
+func copyInstruction(i Instruction) Instruction {
+	original := reflect.ValueOf(i).Elem()
+	clone := reflect.New(original.Type())
+	clone.Elem().Set(original)
+	return clone.Interface().(Instruction)
+}
+
 func (i instruction) String() string {
-	result := fmt.Sprintf("%s %s %s", i.opcode, i.destination, i.operandA)
+	result := fmt.Sprintf("%s %s", i.opcode, i.destination)
+	if i.operandA.Type != operandTypeInvalid {
+		result += fmt.Sprintf(" %s", i.operandA)
+	}
 	if i.operandB.Type != operandTypeInvalid {
 		result += fmt.Sprintf(" %s", i.operandB)
 	}
@@ -188,33 +321,72 @@ func (i *instruction) SetOperandB(o Operand) {
 	i.operandB = o
 }
 
-func (i *instruction) AcquireDestintion() {
-	i.cpu.Registers.Acquire(i.destination.Register)
-	i.destinationAcquired = true
+// Acquire locks a register that this instruction will write
+func (i *instruction) Acquire(register Register) {
+	i.cpu.Registers.Acquire(register)
+	i.acquired = append(i.acquired, register)
 }
 
+// ReleaseDestintion releases every register acquired by the instruction
 func (i *instruction) ReleaseDestintion() {
-	if i.destinationAcquired {
-		i.cpu.Registers.Release(i.destination.Register)
-		i.destinationAcquired = false
+	for _, register := range i.acquired {
+		i.cpu.Registers.Release(register)
+	}
+	i.acquired = nil
+}
+
+// produce makes a result available to the forwarding muxes, the register
+// file is only written in WB
+func (i *instruction) produce(register Register, value Word) {
+	i.results = append(i.results, result{register, value})
+}
+
+// Result returns the value produced for a register, if there is one yet
+func (i *instruction) Result(register Register) (Word, bool) {
+	for _, r := range i.results {
+		if r.register == register {
+			return r.value, true
+		}
+	}
+	return 0, false
+}
+
+// writeBack writes the produced values to the register file and releases
+// the registers acquired by the instruction
+func (i *instruction) writeBack() error {
+	i.ReleaseDestintion()
+	for _, r := range i.results {
+		if err := i.cpu.writeRegister(r.register, r.value); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (i *instruction) Flush() {
 	i.ReleaseDestintion()
 }
 
+func (i *instruction) Unit() string {
+	return "EX"
+}
+
+func (i *instruction) Writes() []Register {
+	return nil
+}
+
 // Default blank stage implementations
 
-func (i *instruction) IF1() error  { return nil }
-func (i *instruction) IF2() error  { return nil }
-func (i *instruction) IF3() error  { return nil }
-func (i *instruction) ID() error   { return nil }
-func (i *instruction) EX() error   { return nil }
-func (i *instruction) MEM1() error { return nil }
-func (i *instruction) MEM2() error { return nil }
-func (i *instruction) MEM3() error { return nil }
-func (i *instruction) WB() error   { return nil }
+func (i *instruction) IF1() error     { return nil }
+func (i *instruction) IF2() error     { return nil }
+func (i *instruction) IF3() error     { return nil }
+func (i *instruction) ID() error      { return nil }
+func (i *instruction) Resolve() error { return nil }
+func (i *instruction) EX() error      { return nil }
+func (i *instruction) MEM1() error    { return nil }
+func (i *instruction) MEM2() error    { return nil }
+func (i *instruction) MEM3() error    { return nil }
+func (i *instruction) WB() error      { return nil }
 
 ////////////////////////////////////////////////////////////////
 // Actual Instruction Implementations
@@ -224,6 +396,26 @@ type loadStoreInstruction struct {
 	instruction
 	address Word
 	value   Word
+	size    int  // bytes accessed
+	signed  bool // sign-extend loaded values
+}
+
+func newLoadStore(size int, signed bool) loadStoreInstruction {
+	return loadStoreInstruction{size: size, signed: signed}
+}
+
+// MEM1 faults on misaligned and out of range accesses
+func (i *loadStoreInstruction) MEM1() error {
+	return i.cpu.Ram.CheckAccess(i.address, i.size)
+}
+
+// extend sign-extends a loaded value to 64 bits if required
+func (i *loadStoreInstruction) extend(value Word) Word {
+	if i.signed == false || i.size == WordSize {
+		return value
+	}
+	shift := uint(64 - 8*i.size)
+	return Word(int64(value<<shift) >> shift)
 }
 
 ////////////////////////////////////////////////////////////////
@@ -240,37 +432,32 @@ func (i *LD) ID() error {
 		return err
 	}
 	i.address = val
-	i.AcquireDestintion()
-
 	return nil
 }
 
+func (i *LD) Writes() []Register {
+	return []Register{i.destination.Register}
+}
+
 func (i *LD) MEM3() error {
 	//fmt.Println("MEM1 LD", i)
-	i.value = i.cpu.Ram[i.address]
-
-	// if forwarding is enabled writeback early
-	// @todo for accuracy this shoudl be implemented with something akin to
-	// an inter-pipeline register
-	if i.cpu.ForwardingEnabled {
-		return i.performWB()
+	value, err := i.cpu.Ram.Load(i.address, i.size)
+	if err != nil {
+		return err
 	}
-	return nil
-}
+	i.value = i.extend(value)
 
-func (i *LD) performWB() error {
-	i.ReleaseDestintion()
-	return i.cpu.Registers.Set(i.destination.Register, i.value)
+	// the loaded value is forwarded from the MEM3 latch
+	i.produce(i.destination.Register, i.value)
+	return nil
 }
 
 func (i *LD) WB() error {
-	// if forwarding is not enabled then we've already provided the register value
-	if i.cpu.ForwardingEnabled == false {
-		return i.performWB()
-	}
-	return nil
+	return i.writeBack()
 }
 
+func (i *LD) accesses() (reads, writes int) { return 1, 0 }
+
 ////////////////////////////////////////////////////////////////
 // SD
 ////////////////////////////////////////////////////////////////
@@ -279,15 +466,25 @@ type SD struct {
 	loadStoreInstruction
 }
 
+// addressAndValue returns the operands of a store, which may be written
+// either as SD 0(R1), R4 or, as in MIPS assembly, SD R4, 0(R1)
+func (i *SD) addressAndValue() (address, value Operand) {
+	if i.destination.Type == operandTypeOffset {
+		return i.destination, i.operandA
+	}
+	return i.operandA, i.destination
+}
+
 func (i *SD) ID() error {
+	address, value := i.addressAndValue()
 
-	val, err := i.operandA.Value(i.cpu)
+	val, err := value.Value(i.cpu)
 	if err != nil {
 		return err
 	}
 	i.value = val
 
-	val, err = i.destination.Value(i.cpu)
+	val, err = address.Value(i.cpu)
 	if err != nil {
 		return err
 	}
@@ -298,9 +495,58 @@ func (i *SD) ID() error {
 
 func (i *SD) WB() error {
 	//fmt.Println("WD SD", i)
-	i.cpu.Ram[i.address] = i.value
-	// @todo memory write errors, etc
-	return nil
+	return i.cpu.Ram.Store(i.address, i.size, i.value)
+}
+
+func (i *SD) accesses() (reads, writes int) { return 0, 1 }
+
+////////////////////////////////////////////////////////////////
+// Sized loads and stores
+////////////////////////////////////////////////////////////////
+
+// LW R2, 0(R1) loads a sign-extended 32 bit word
+type LW struct {
+	LD
+}
+
+// LWU R2, 0(R1) loads a zero-extended 32 bit word
+type LWU struct {
+	LD
+}
+
+// LH R2, 0(R1) loads a sign-extended halfword
+type LH struct {
+	LD
+}
+
+// LHU R2, 0(R1) loads a zero-extended halfword
+type LHU struct {
+	LD
+}
+
+// LB R2, 0(R1) loads a sign-extended byte
+type LB struct {
+	LD
+}
+
+// LBU R2, 0(R1) loads a zero-extended byte
+type LBU struct {
+	LD
+}
+
+// SW 0(R1), R2 stores the low 32 bits of R2
+type SW struct {
+	SD
+}
+
+// SH 0(R1), R2 stores the low halfword of R2
+type SH struct {
+	SD
+}
+
+// SB 0(R1), R2 stores the low byte of R2
+type SB struct {
+	SD
 }
 
 ////////////////////////////////////////////////////////////////
@@ -313,16 +559,51 @@ type ALUInstruction struct {
 	value  Word
 }
 
-func (i *ALUInstruction) performWB() error {
-	i.ReleaseDestintion()
-	return i.cpu.Registers.Set(i.destination.Register, i.value)
+// ID reads both source operands into the temporaries, the hazard unit
+// reserves the destination register. Instructions with a single source
+// (LUI) leave operandB unset.
+func (i *ALUInstruction) ID() (err error) {
+
+	i.t1, err = i.operandA.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+
+	if i.operandB.Type != operandTypeInvalid {
+		i.t2, err = i.operandB.Value(i.cpu)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// complete records the result computed in EX, it is forwarded from the EX
+// latch
+func (i *ALUInstruction) complete(value Word) error {
+	i.value = value
+	i.produce(i.destination.Register, value)
+	return nil
+}
+
+func (i *ALUInstruction) Writes() []Register {
+	return []Register{i.destination.Register}
 }
 
 func (i *ALUInstruction) WB() error {
-	if i.cpu.ForwardingEnabled == false {
-		return i.performWB()
+	return i.writeBack()
+}
+
+// immediates are 16 bits wide; logical instructions zero-extend them
+func zeroExtend(w Word) Word {
+	return w & 0xffff
+}
+
+func boolWord(b bool) Word {
+	if b {
+		return 1
 	}
-	return nil
+	return 0
 }
 
 ////////////////////////////////////////////////////////////////
@@ -333,157 +614,1155 @@ type DADD struct {
 	ALUInstruction
 }
 
-func (i *DADD) ID() (err error) {
+func (i *DADD) EX() error {
+	// @todo consider overflow?
+	return i.complete(i.t1 + i.t2)
+}
 
-	i.t1, err = i.operandA.Value(i.cpu)
-	if err != nil {
-		return err
-	}
+////////////////////////////////////////////////////////////////
+// DADDI
+////////////////////////////////////////////////////////////////
 
-	i.t2, err = i.operandB.Value(i.cpu)
-	if err != nil {
-		return err
-	}
-	i.AcquireDestintion()
-	return nil
+type DADDI struct {
+	ALUInstruction
 }
 
-func (i *DADD) EX() error {
-	//fmt.Println("DADD EX", i)
-	// @todo consider overflow?
-	i.value = i.t1 + i.t2
+func (i *DADDI) EX() error {
+	// @todo consider overflow
+	return i.complete(i.t1 + i.t2)
+}
 
-	if i.cpu.ForwardingEnabled == true {
-		return i.performWB()
-	}
-	return nil
+////////////////////////////////////////////////////////////////
+// DADDU
+////////////////////////////////////////////////////////////////
+
+type DADDU struct {
+	ALUInstruction
+}
+
+func (i *DADDU) EX() error {
+	return i.complete(i.t1 + i.t2)
 }
 
 ////////////////////////////////////////////////////////////////
-// DADDI
+// DADDIU
 ////////////////////////////////////////////////////////////////
 
-type DADDI struct {
+type DADDIU struct {
 	ALUInstruction
 }
 
-func (i *DADDI) ID() (err error) {
+func (i *DADDIU) EX() error {
+	return i.complete(i.t1 + i.t2)
+}
 
-	i.t1, err = i.operandA.Value(i.cpu)
-	if err != nil {
-		return err
-	}
+////////////////////////////////////////////////////////////////
+// DSUB
+////////////////////////////////////////////////////////////////
 
-	i.t2, err = i.operandB.Value(i.cpu)
-	if err != nil {
-		return err
-	}
-	i.AcquireDestintion()
-	return nil
+type DSUB struct {
+	ALUInstruction
 }
 
-func (i *DADDI) EX() error {
-	//fmt.Println("DADDI EX", i)
-	i.value = i.t1 + i.t2
+func (i *DSUB) EX() error {
 	// @todo consider overflow
-	if i.cpu.ForwardingEnabled == true {
-		return i.performWB()
-	}
-	return nil
+	return i.complete(i.t1 - i.t2)
 }
 
 ////////////////////////////////////////////////////////////////
-// BNEZ
+// DSUBU
 ////////////////////////////////////////////////////////////////
 
-type BNEZ struct {
-	instruction
-	target Word
-	nextPC int
+type DSUBU struct {
+	ALUInstruction
 }
 
-func (i *BNEZ) IF1() (err error) {
-	//fmt.Println("BNEZ IF1")
-	i.nextPC = i.cpu.InstructionPointer
-	switch i.cpu.BranchMode {
-	case BranchPolicyFlush:
-		return BranchResolving
-	case BranchPolicyPredictNotTaken:
-		return nil
-	case BranchPolicyPredictTaken:
-		return nil
-	}
-	return nil
+func (i *DSUBU) EX() error {
+	return i.complete(i.t1 - i.t2)
 }
 
-func (i *BNEZ) IF2() (err error) {
-	i.target, err = i.operandA.Value(i.cpu)
-	if err != nil {
-		return err
-	}
-	switch i.cpu.BranchMode {
-	case BranchPolicyFlush:
-		return BranchResolving
-	case BranchPolicyPredictNotTaken:
-		return nil
-	case BranchPolicyPredictTaken:
-		//fmt.Println("Predicting taken, flushing and setting PC")
-		i.cpu.InstructionPointer = int(i.target)
-		return FlushPipeline
-	}
-	return nil
+////////////////////////////////////////////////////////////////
+// AND
+////////////////////////////////////////////////////////////////
+
+type AND struct {
+	ALUInstruction
 }
 
-func (i *BNEZ) IF3() (err error) {
-	//fmt.Println("BNEZ IF3")
-	if i.cpu.BranchMode == BranchPolicyFlush {
-		return BranchResolving
-	}
-	return nil
+func (i *AND) EX() error {
+	return i.complete(i.t1 & i.t2)
 }
 
-func (i *BNEZ) ID() (err error) {
-	//fmt.Println("BNEZ ID")
-	// note, "destination" is a misnomer, the second argument, operandA is the target
-	val, err := i.destination.Value(i.cpu)
-	if err != nil {
-		//fmt.Println("BNEZ ", err)
-		return err
-	}
-	//fmt.Println("BNEZ GO")
-	branchTaken := val != 0
-	switch i.cpu.BranchMode {
-	case BranchPolicyFlush:
-		if branchTaken {
-			//fmt.Println("setting pc!", i.target, val)
-			i.cpu.InstructionPointer = int(i.target)
-			return FlushPipeline
-		} else {
-			//fmt.Println("setting pc to start!", i.nextPC)
-			i.cpu.InstructionPointer = i.nextPC
-			return FlushPipeline
-		}
+////////////////////////////////////////////////////////////////
+// ANDI
+////////////////////////////////////////////////////////////////
 
-	case BranchPolicyPredictNotTaken:
-		if branchTaken {
-			//fmt.Println("prediction incorrect, setting pc and flushing!", i.target)
-			i.cpu.InstructionPointer = int(i.target)
-			return FlushPipeline
-		} else {
-			//fmt.Println("prediction correct! continuing normally", i.target)
-			return nil
-		}
+type ANDI struct {
+	ALUInstruction
+}
 
-	case BranchPolicyPredictTaken:
-		if branchTaken {
-			//fmt.Println("prediction correct, continuing normally!")
-			return nil
-		} else {
-			//fmt.Println("prediction incorrect, setting pc and flushing!", i.target)
-			i.cpu.InstructionPointer = int(i.nextPC)
-			return FlushPipeline
-		}
-	}
+func (i *ANDI) EX() error {
+	return i.complete(i.t1 & zeroExtend(i.t2))
+}
 
-	return nil
+////////////////////////////////////////////////////////////////
+// OR
+////////////////////////////////////////////////////////////////
+
+type OR struct {
+	ALUInstruction
+}
+
+func (i *OR) EX() error {
+	return i.complete(i.t1 | i.t2)
+}
+
+////////////////////////////////////////////////////////////////
+// ORI
+////////////////////////////////////////////////////////////////
+
+type ORI struct {
+	ALUInstruction
+}
+
+func (i *ORI) EX() error {
+	return i.complete(i.t1 | zeroExtend(i.t2))
+}
+
+////////////////////////////////////////////////////////////////
+// XOR
+////////////////////////////////////////////////////////////////
+
+type XOR struct {
+	ALUInstruction
+}
+
+func (i *XOR) EX() error {
+	return i.complete(i.t1 ^ i.t2)
+}
+
+////////////////////////////////////////////////////////////////
+// XORI
+////////////////////////////////////////////////////////////////
+
+type XORI struct {
+	ALUInstruction
+}
+
+func (i *XORI) EX() error {
+	return i.complete(i.t1 ^ zeroExtend(i.t2))
+}
+
+////////////////////////////////////////////////////////////////
+// NOR
+////////////////////////////////////////////////////////////////
+
+type NOR struct {
+	ALUInstruction
+}
+
+func (i *NOR) EX() error {
+	return i.complete(^(i.t1 | i.t2))
+}
+
+////////////////////////////////////////////////////////////////
+// SLT
+////////////////////////////////////////////////////////////////
+
+type SLT struct {
+	ALUInstruction
+}
+
+func (i *SLT) EX() error {
+	return i.complete(boolWord(int64(i.t1) < int64(i.t2)))
+}
+
+////////////////////////////////////////////////////////////////
+// SLTI
+////////////////////////////////////////////////////////////////
+
+type SLTI struct {
+	ALUInstruction
+}
+
+func (i *SLTI) EX() error {
+	return i.complete(boolWord(int64(i.t1) < int64(i.t2)))
+}
+
+////////////////////////////////////////////////////////////////
+// SLTU
+////////////////////////////////////////////////////////////////
+
+type SLTU struct {
+	ALUInstruction
+}
+
+func (i *SLTU) EX() error {
+	return i.complete(boolWord(i.t1 < i.t2))
+}
+
+////////////////////////////////////////////////////////////////
+// SLTIU
+////////////////////////////////////////////////////////////////
+
+type SLTIU struct {
+	ALUInstruction
+}
+
+// the immediate is sign-extended before the unsigned comparison
+func (i *SLTIU) EX() error {
+	return i.complete(boolWord(i.t1 < i.t2))
+}
+
+////////////////////////////////////////////////////////////////
+// LUI
+////////////////////////////////////////////////////////////////
+
+type LUI struct {
+	ALUInstruction
+}
+
+// LUI has a single immediate source, held in operandA. The 32 bit result is
+// sign-extended to 64 bits.
+func (i *LUI) EX() error {
+	return i.complete(Word(int64(int32(uint32(zeroExtend(i.t1)) << 16))))
+}
+
+////////////////////////////////////////////////////////////////
+// Shifts
+////////////////////////////////////////////////////////////////
+
+// shiftImmediate is the base of shifts whose amount is encoded in the
+// instruction, e.g. DSLL R1, R2, 4
+type shiftImmediate struct {
+	ALUInstruction
+}
+
+func (i *shiftImmediate) validateOperands() error {
+	if i.operandB.Type != operandTypeImmediate {
+		return errors.New(fmt.Sprintf("%s requires an immediate shift amount", i.opcode))
+	}
+	if i.operandB.Offset < 0 || i.operandB.Offset > 31 {
+		return errors.New(fmt.Sprintf("Invalid shift amount %d, must be between 0 and 31", i.operandB.Offset))
+	}
+	return nil
+}
+
+func (i *shiftImmediate) amount() uint {
+	return uint(i.t2)
+}
+
+// shiftVariable is the base of shifts whose amount is taken from the low six
+// bits of a register, e.g. DSLLV R1, R2, R3
+type shiftVariable struct {
+	ALUInstruction
+}
+
+func (i *shiftVariable) validateOperands() error {
+	if i.operandB.Type != operandTypeNormal {
+		return errors.New(fmt.Sprintf("%s requires a register shift amount", i.opcode))
+	}
+	return nil
+}
+
+func (i *shiftVariable) amount() uint {
+	return uint(i.t2 & 0x3f)
+}
+
+// Word is unsigned, so arithmetic shifts go through int64 to replicate the
+// sign bit
+func shiftRightArithmetic(w Word, n uint) Word {
+	return Word(int64(w) >> n)
+}
+
+////////////////////////////////////////////////////////////////
+// DSLL
+////////////////////////////////////////////////////////////////
+
+type DSLL struct {
+	shiftImmediate
+}
+
+func (i *DSLL) EX() error {
+	return i.complete(i.t1 << i.amount())
+}
+
+////////////////////////////////////////////////////////////////
+// DSRL
+////////////////////////////////////////////////////////////////
+
+type DSRL struct {
+	shiftImmediate
+}
+
+func (i *DSRL) EX() error {
+	return i.complete(i.t1 >> i.amount())
+}
+
+////////////////////////////////////////////////////////////////
+// DSRA
+////////////////////////////////////////////////////////////////
+
+type DSRA struct {
+	shiftImmediate
+}
+
+func (i *DSRA) EX() error {
+	return i.complete(shiftRightArithmetic(i.t1, i.amount()))
+}
+
+////////////////////////////////////////////////////////////////
+// DSLL32
+////////////////////////////////////////////////////////////////
+
+type DSLL32 struct {
+	shiftImmediate
+}
+
+func (i *DSLL32) EX() error {
+	return i.complete(i.t1 << (i.amount() + 32))
+}
+
+////////////////////////////////////////////////////////////////
+// DSRL32
+////////////////////////////////////////////////////////////////
+
+type DSRL32 struct {
+	shiftImmediate
+}
+
+func (i *DSRL32) EX() error {
+	return i.complete(i.t1 >> (i.amount() + 32))
+}
+
+////////////////////////////////////////////////////////////////
+// DSRA32
+////////////////////////////////////////////////////////////////
+
+type DSRA32 struct {
+	shiftImmediate
+}
+
+func (i *DSRA32) EX() error {
+	return i.complete(shiftRightArithmetic(i.t1, i.amount()+32))
+}
+
+////////////////////////////////////////////////////////////////
+// DSLLV
+////////////////////////////////////////////////////////////////
+
+type DSLLV struct {
+	shiftVariable
+}
+
+func (i *DSLLV) EX() error {
+	return i.complete(i.t1 << i.amount())
+}
+
+////////////////////////////////////////////////////////////////
+// DSRLV
+////////////////////////////////////////////////////////////////
+
+type DSRLV struct {
+	shiftVariable
+}
+
+func (i *DSRLV) EX() error {
+	return i.complete(i.t1 >> i.amount())
+}
+
+////////////////////////////////////////////////////////////////
+// DSRAV
+////////////////////////////////////////////////////////////////
+
+type DSRAV struct {
+	shiftVariable
+}
+
+func (i *DSRAV) EX() error {
+	return i.complete(shiftRightArithmetic(i.t1, i.amount()))
+}
+
+////////////////////////////////////////////////////////////////
+// Multiply and divide
+////////////////////////////////////////////////////////////////
+
+// hiLoInstruction is the base of multiplies and divides that leave their
+// result in HI and LO, e.g. DMULT R1, R2. As with BNEZ the first source
+// register is held in "destination".
+type hiLoInstruction struct {
+	instruction
+	t1, t2 Word // temporaries
+	hi, lo Word
+}
+
+func (i *hiLoInstruction) Writes() []Register {
+	return []Register{HI, LO}
+}
+
+func (i *hiLoInstruction) ID() (err error) {
+	i.t1, err = i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	i.t2, err = i.operandA.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (i *hiLoInstruction) complete(hi, lo Word) error {
+	i.hi, i.lo = hi, lo
+	i.produce(HI, hi)
+	i.produce(LO, lo)
+	return nil
+}
+
+func (i *hiLoInstruction) WB() error {
+	return i.writeBack()
+}
+
+// multiplyInstruction executes in the multiplier
+type multiplyInstruction struct {
+	hiLoInstruction
+}
+
+func (i *multiplyInstruction) Unit() string {
+	return "M"
+}
+
+// divideInstruction executes in the divider
+type divideInstruction struct {
+	hiLoInstruction
+}
+
+func (i *divideInstruction) Unit() string {
+	return "DIV"
+}
+
+////////////////////////////////////////////////////////////////
+// DMUL
+////////////////////////////////////////////////////////////////
+
+// DMUL R1, R2, R3 writes the low 64 bits of the product to R1
+type DMUL struct {
+	ALUInstruction
+}
+
+func (i *DMUL) Unit() string {
+	return "M"
+}
+
+func (i *DMUL) EX() error {
+	return i.complete(i.t1 * i.t2)
+}
+
+////////////////////////////////////////////////////////////////
+// DMULT
+////////////////////////////////////////////////////////////////
+
+type DMULT struct {
+	multiplyInstruction
+}
+
+// the unsigned 128 bit product is corrected for negative operands
+func (i *DMULT) EX() error {
+	hi, lo := bits.Mul64(uint64(i.t1), uint64(i.t2))
+	if int64(i.t1) < 0 {
+		hi -= uint64(i.t2)
+	}
+	if int64(i.t2) < 0 {
+		hi -= uint64(i.t1)
+	}
+	return i.complete(Word(hi), Word(lo))
+}
+
+////////////////////////////////////////////////////////////////
+// DDIV
+////////////////////////////////////////////////////////////////
+
+// DDIV R1, R2 leaves the quotient in LO and the remainder in HI. Division by
+// zero is unpredictable on MIPS, here it leaves both zero.
+type DDIV struct {
+	divideInstruction
+}
+
+func (i *DDIV) EX() error {
+	if i.t2 == 0 {
+		return i.complete(0, 0)
+	}
+	a, b := int64(i.t1), int64(i.t2)
+	return i.complete(Word(a%b), Word(a/b))
+}
+
+////////////////////////////////////////////////////////////////
+// DDIVU
+////////////////////////////////////////////////////////////////
+
+type DDIVU struct {
+	divideInstruction
+}
+
+func (i *DDIVU) EX() error {
+	if i.t2 == 0 {
+		return i.complete(0, 0)
+	}
+	return i.complete(i.t1%i.t2, i.t1/i.t2)
+}
+
+////////////////////////////////////////////////////////////////
+// MFHI
+////////////////////////////////////////////////////////////////
+
+// MFHI R1
+type MFHI struct {
+	ALUInstruction
+}
+
+func (i *MFHI) ID() (err error) {
+	i.t1, err = Operand{Register: HI, Type: operandTypeNormal}.Value(i.cpu)
+	return err
+}
+
+func (i *MFHI) Reads() []Register {
+	return []Register{HI}
+}
+
+func (i *MFHI) EX() error {
+	return i.complete(i.t1)
+}
+
+////////////////////////////////////////////////////////////////
+// MFLO
+////////////////////////////////////////////////////////////////
+
+// MFLO R1
+type MFLO struct {
+	ALUInstruction
+}
+
+func (i *MFLO) ID() (err error) {
+	i.t1, err = Operand{Register: LO, Type: operandTypeNormal}.Value(i.cpu)
+	return err
+}
+
+func (i *MFLO) Reads() []Register {
+	return []Register{LO}
+}
+
+func (i *MFLO) EX() error {
+	return i.complete(i.t1)
+}
+
+////////////////////////////////////////////////////////////////
+// Floating point
+////////////////////////////////////////////////////////////////
+
+// L.D F2, 0(R1)
+type L_D struct {
+	LD
+}
+
+// S.D F2, 0(R1)
+type S_D struct {
+	SD
+}
+
+// fpInstruction is the base of double precision arithmetic, operands are
+// the IEEE 754 bit patterns held in the F registers
+type fpInstruction struct {
+	ALUInstruction
+}
+
+func (i *fpInstruction) operands() (float64, float64) {
+	return i.t1.Float(), i.t2.Float()
+}
+
+////////////////////////////////////////////////////////////////
+// ADD.D
+////////////////////////////////////////////////////////////////
+
+type ADD_D struct {
+	fpInstruction
+}
+
+func (i *ADD_D) Unit() string {
+	return "A"
+}
+
+func (i *ADD_D) EX() error {
+	a, b := i.operands()
+	return i.complete(FloatWord(a + b))
+}
+
+////////////////////////////////////////////////////////////////
+// SUB.D
+////////////////////////////////////////////////////////////////
+
+type SUB_D struct {
+	fpInstruction
+}
+
+func (i *SUB_D) Unit() string {
+	return "A"
+}
+
+func (i *SUB_D) EX() error {
+	a, b := i.operands()
+	return i.complete(FloatWord(a - b))
+}
+
+////////////////////////////////////////////////////////////////
+// MUL.D
+////////////////////////////////////////////////////////////////
+
+type MUL_D struct {
+	fpInstruction
+}
+
+func (i *MUL_D) Unit() string {
+	return "M"
+}
+
+func (i *MUL_D) EX() error {
+	a, b := i.operands()
+	return i.complete(FloatWord(a * b))
+}
+
+////////////////////////////////////////////////////////////////
+// DIV.D
+////////////////////////////////////////////////////////////////
+
+type DIV_D struct {
+	fpInstruction
+}
+
+func (i *DIV_D) Unit() string {
+	return "DIV"
+}
+
+func (i *DIV_D) EX() error {
+	a, b := i.operands()
+	return i.complete(FloatWord(a / b))
+}
+
+////////////////////////////////////////////////////////////////
+// C.LT.D
+////////////////////////////////////////////////////////////////
+
+// C.LT.D F2, F4 sets FCC if F2 < F4. As with BNEZ the first source register
+// is held in "destination".
+type C_LT_D struct {
+	instruction
+	t1, t2 Word // temporaries
+	value  Word
+}
+
+func (i *C_LT_D) Unit() string {
+	return "A"
+}
+
+func (i *C_LT_D) Writes() []Register {
+	return []Register{FCC}
+}
+
+func (i *C_LT_D) ID() (err error) {
+	i.t1, err = i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	i.t2, err = i.operandA.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (i *C_LT_D) EX() error {
+	i.value = boolWord(i.t1.Float() < i.t2.Float())
+	i.produce(FCC, i.value)
+	return nil
+}
+
+func (i *C_LT_D) WB() error {
+	return i.writeBack()
+}
+
+////////////////////////////////////////////////////////////////
+// Branches and jumps
+////////////////////////////////////////////////////////////////
+
+// branchInstruction implements the branch policies shared by all control
+// transfer instructions. Concrete branches supply the target operand in IF2
+// and the outcome in ID.
+type branchInstruction struct {
+	instruction
+	target         Word
+	pc             int // fetched from, BTB and predictor entries are keyed on it
+	nextPC         int // after the delay slots
+	fetched        int // instructions fetched up to the branch
+	predictedTaken bool
+	predicted      Word // the target fetch was redirected to
+	fromRAS        bool // predicted by the return address stack
+	taken          bool // actual outcome, known after ID
+	link           bool // write the return address to linkRegister
+	linkRegister   Register
+	ras            []Word // the RAS after the branch's own call or return
+}
+
+func (i *branchInstruction) IF1() (err error) {
+	i.pc = i.cpu.InstructionPointer - 1
+	i.nextPC = i.cpu.InstructionPointer + i.cpu.DelaySlots
+	i.fetched = len(i.cpu.Instructions)
+	i.checkpoint()
+	if i.cpu.BranchMode == BranchPolicyFlush {
+		return BranchResolving
+	}
+	if i.cpu.BTB == nil {
+		return nil
+	}
+	// with a BTB the target is known in fetch, a miss is predicted not taken
+	if target, ok := i.cpu.BTB.Lookup(i.pc); ok && i.predictsTaken() {
+		i.redirect(target)
+	}
+	return nil
+}
+
+// predict decodes the target and, when predicting taken, redirects fetch.
+// Register targets are not known until ID, so they are predicted not taken.
+// With a BTB the prediction has been made in IF1 already.
+func (i *branchInstruction) predict(target Operand) (err error) {
+	if target.Type == operandTypeLabel {
+		i.target, err = target.Value(i.cpu)
+		if err != nil {
+			return err
+		}
+	}
+	switch {
+	case i.cpu.BranchMode == BranchPolicyFlush:
+		return BranchResolving
+	case i.cpu.BTB != nil, target.Type != operandTypeLabel, i.predictsTaken() == false:
+		return nil
+	}
+	i.redirect(i.target)
+	return FlushPipeline
+}
+
+// call pushes the return address of a call on the RAS
+func (i *branchInstruction) call() {
+	if i.cpu.RAS != nil && i.cpu.BranchMode != BranchPolicyFlush {
+		i.cpu.RAS.Push(Word(i.nextPC))
+		i.checkpoint()
+	}
+}
+
+// checkpoint notes the RAS as the branch leaves it, the calls and returns
+// fetched after a mispredicted branch are undone when it resolves
+func (i *branchInstruction) checkpoint() {
+	if i.cpu.RAS != nil {
+		i.ras = i.cpu.RAS.checkpoint()
+	}
+}
+
+// predictReturn predicts the target of a return from the RAS, overriding a
+// prediction made in IF1
+func (i *branchInstruction) predictReturn(target Operand) error {
+	if err := i.predict(target); err != nil || i.cpu.RAS == nil {
+		return err
+	}
+	address, ok := i.cpu.RAS.Pop()
+	i.checkpoint()
+	if ok == false {
+		return nil
+	}
+	i.fromRAS = true
+	if i.predictedTaken && i.predicted == address {
+		return nil
+	}
+	i.redirect(address)
+	return FlushPipeline
+}
+
+// predictsTaken returns the policy's prediction for the branch
+func (i *branchInstruction) predictsTaken() bool {
+	switch i.cpu.BranchMode {
+	case BranchPolicyPredictTaken:
+		return true
+	case BranchPolicyPredictDynamic:
+		return i.cpu.Predictor.Predict(i.pc)
+	}
+	return false
+}
+
+func (i *branchInstruction) redirect(target Word) {
+	i.predictedTaken = true
+	i.predicted = target
+	i.jump(int(target))
+}
+
+// jump redirects fetch to pc, once the delay slots of the branch have been
+// fetched
+func (i *branchInstruction) jump(pc int) {
+	left := i.cpu.DelaySlots - (len(i.cpu.Instructions) - i.fetched)
+	if left > 0 && i.cpu.InstructionCacheEmpty() == false {
+		i.cpu.delaySlots, i.cpu.delayedJump = left, pc
+		return
+	}
+	i.cpu.delaySlots = 0
+	i.cpu.InstructionPointer = pc
+}
+
+// mispredicted reports whether fetch went the wrong way, or to the wrong
+// target. Nothing is predicted under BranchPolicyFlush.
+func (i *branchInstruction) mispredicted() bool {
+	switch {
+	case i.cpu.BranchMode == BranchPolicyFlush:
+		return false
+	case i.taken != i.predictedTaken:
+		return true
+	}
+	return i.taken && i.predicted != i.target
+}
+
+// flushes reports whether resolving the branch flushes the pipeline, always
+// under BranchPolicyFlush
+func (i *branchInstruction) flushes() bool {
+	return i.cpu.BranchMode == BranchPolicyFlush || i.mispredicted()
+}
+
+func (i *branchInstruction) IF3() (err error) {
+	if i.cpu.BranchMode == BranchPolicyFlush {
+		return BranchResolving
+	}
+	return nil
+}
+
+// decide records the actual outcome in ID, it takes effect when the branch
+// reaches the stage resolving branches
+func (i *branchInstruction) decide(taken bool) error {
+	i.taken = taken
+	return nil
+}
+
+// Resolve compares the actual outcome with the prediction, redirecting the
+// instruction pointer and flushing on a misprediction
+func (i *branchInstruction) Resolve() error {
+	if i.cpu.BranchMode == BranchPolicyPredictDynamic {
+		i.cpu.Predictor.Update(i.pc, i.taken)
+	}
+	if i.cpu.BTB != nil && i.taken {
+		i.cpu.BTB.Insert(i.pc, i.target)
+	}
+	if i.fromRAS && i.predicted == i.target {
+		i.cpu.RAS.Hits++
+	} else if i.fromRAS {
+		i.cpu.RAS.Misses++
+	}
+	if i.flushes() == false {
+		return nil
+	}
+	if i.ras != nil {
+		i.cpu.RAS.restore(i.ras)
+	}
+	if i.taken {
+		i.jump(int(i.target))
+	} else {
+		i.jump(i.nextPC)
+	}
+	return FlushPipeline
+}
+
+// outcome reports whether the branch was taken, whether it was predicted and
+// whether resolving it flushed the pipeline
+func (i *branchInstruction) outcome() (taken, predicted, flushed bool) {
+	return i.taken, i.cpu.BranchMode != BranchPolicyFlush, i.flushes()
+}
+
+// readTarget reads the target in ID. Label targets have usually been
+// decoded in IF2 already, register targets (JR) are only known now.
+func (i *branchInstruction) readTarget(o Operand) (err error) {
+	i.target, err = o.Value(i.cpu)
+	return err
+}
+
+// EX produces the return address of linking jumps
+func (i *branchInstruction) EX() error {
+	if i.link {
+		i.produce(i.linkRegister, Word(i.nextPC))
+	}
+	return nil
+}
+
+func (i *branchInstruction) WB() error {
+	return i.writeBack()
+}
+
+////////////////////////////////////////////////////////////////
+// BEQ
+////////////////////////////////////////////////////////////////
+
+// BEQ R1, R2, Label
+type BEQ struct {
+	branchInstruction
+}
+
+func (i *BEQ) IF2() error {
+	return i.predict(i.operandB)
+}
+
+func (i *BEQ) ID() error {
+	a, err := i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	b, err := i.operandA.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.operandB); err != nil {
+		return err
+	}
+	return i.decide(a == b)
+}
+
+////////////////////////////////////////////////////////////////
+// BNE
+////////////////////////////////////////////////////////////////
+
+// BNE R1, R2, Label
+type BNE struct {
+	branchInstruction
+}
+
+func (i *BNE) IF2() error {
+	return i.predict(i.operandB)
+}
+
+func (i *BNE) ID() error {
+	a, err := i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	b, err := i.operandA.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.operandB); err != nil {
+		return err
+	}
+	return i.decide(a != b)
+}
+
+////////////////////////////////////////////////////////////////
+// BEQZ
+////////////////////////////////////////////////////////////////
+
+// BEQZ R1, Label
+type BEQZ struct {
+	branchInstruction
+}
+
+func (i *BEQZ) IF2() error {
+	return i.predict(i.operandA)
+}
+
+func (i *BEQZ) ID() error {
+	val, err := i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.operandA); err != nil {
+		return err
+	}
+	return i.decide(val == 0)
+}
+
+////////////////////////////////////////////////////////////////
+// BNEZ
+////////////////////////////////////////////////////////////////
+
+// BNEZ R1, Label
+//
+// note, "destination" is a misnomer, it holds the tested register and
+// operandA is the target
+type BNEZ struct {
+	branchInstruction
+}
+
+func (i *BNEZ) IF2() error {
+	return i.predict(i.operandA)
+}
+
+func (i *BNEZ) ID() error {
+	val, err := i.destination.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.operandA); err != nil {
+		return err
+	}
+	return i.decide(val != 0)
+}
+
+////////////////////////////////////////////////////////////////
+// J
+////////////////////////////////////////////////////////////////
+
+// J Label
+type J struct {
+	branchInstruction
+}
+
+func (i *J) IF2() error {
+	return i.predict(i.destination)
+}
+
+func (i *J) ID() error {
+	if err := i.readTarget(i.destination); err != nil {
+		return err
+	}
+	return i.decide(true)
+}
+
+////////////////////////////////////////////////////////////////
+// JAL
+////////////////////////////////////////////////////////////////
+
+// JAL Label, the return address is written to R31
+type JAL struct {
+	branchInstruction
+}
+
+func (i *JAL) IF2() error {
+	i.call()
+	return i.predict(i.destination)
+}
+
+func (i *JAL) Writes() []Register {
+	return []Register{R31}
+}
+
+func (i *JAL) ID() error {
+	if err := i.readTarget(i.destination); err != nil {
+		return err
+	}
+	i.link, i.linkRegister = true, R31
+	return i.decide(true)
+}
+
+////////////////////////////////////////////////////////////////
+// JR
+////////////////////////////////////////////////////////////////
+
+// JR R31
+type JR struct {
+	branchInstruction
+}
+
+func (i *JR) IF2() error {
+	if i.destination.Register == R31 {
+		return i.predictReturn(i.destination)
+	}
+	return i.predict(i.destination)
+}
+
+func (i *JR) ID() error {
+	if err := i.readTarget(i.destination); err != nil {
+		return err
+	}
+	return i.decide(true)
+}
+
+////////////////////////////////////////////////////////////////
+// JALR
+////////////////////////////////////////////////////////////////
+
+// JALR R1 links to R31, JALR R2, R1 links to R2
+type JALR struct {
+	branchInstruction
+}
+
+// targetRegister returns the operand holding the jump target
+func (i *JALR) targetRegister() Operand {
+	if i.operandA.Type == operandTypeInvalid {
+		return i.destination
+	}
+	return i.operandA
+}
+
+func (i *JALR) Writes() []Register {
+	if i.operandA.Type == operandTypeInvalid {
+		return []Register{R31}
+	}
+	return []Register{i.destination.Register}
+}
+
+func (i *JALR) IF2() error {
+	i.call()
+	return i.predict(i.targetRegister())
+}
+
+func (i *JALR) ID() error {
+	if err := i.readTarget(i.targetRegister()); err != nil {
+		return err
+	}
+	i.link, i.linkRegister = true, i.Writes()[0]
+	return i.decide(true)
+}
+
+////////////////////////////////////////////////////////////////
+// BC1T
+////////////////////////////////////////////////////////////////
+
+// BC1T Label branches if FCC is set
+type BC1T struct {
+	branchInstruction
+}
+
+func (i *BC1T) Reads() []Register {
+	return []Register{FCC}
+}
+
+func (i *BC1T) IF2() error {
+	return i.predict(i.destination)
+}
+
+func (i *BC1T) ID() error {
+	val, err := Operand{Register: FCC, Type: operandTypeNormal}.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.destination); err != nil {
+		return err
+	}
+	return i.decide(val != 0)
+}
+
+////////////////////////////////////////////////////////////////
+// BC1F
+////////////////////////////////////////////////////////////////
+
+// BC1F Label branches if FCC is clear
+type BC1F struct {
+	branchInstruction
+}
+
+func (i *BC1F) Reads() []Register {
+	return []Register{FCC}
+}
+
+func (i *BC1F) IF2() error {
+	return i.predict(i.destination)
+}
+
+func (i *BC1F) ID() error {
+	val, err := Operand{Register: FCC, Type: operandTypeNormal}.Value(i.cpu)
+	if err != nil {
+		return err
+	}
+	if err := i.readTarget(i.destination); err != nil {
+		return err
+	}
+	return i.decide(val == 0)
 }
@@ -0,0 +1,219 @@
+package mips
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Stage roles in a machine description, each runs some of the instruction
+// hooks. A stage without roles just holds an instruction for a cycle.
+const (
+	RoleFetch         = "fetch"            // IF1, fetches the instruction
+	RolePredict       = "predict"          // IF2 and IF3, branch prediction
+	RoleReadOperands  = "read operands"    // ID
+	RoleResolveBranch = "resolve branches" // the read operands stage unless given, before execute
+	RoleExecute       = "execute"          // EX, dispatch to the functional units
+	RoleMemory        = "memory"           // MEM1, MEM2 and MEM3
+	RoleWriteBack     = "writeback"        // WB
+)
+
+var roleHooks = map[string][]string{
+	RoleFetch:         {"IF1"},
+	RolePredict:       {"IF2", "IF3"},
+	RoleReadOperands:  {"ID"},
+	RoleResolveBranch: {"Resolve"},
+	RoleExecute:       {"EX"},
+	RoleMemory:        {"MEM1", "MEM2", "MEM3"},
+	RoleWriteBack:     {"WB"},
+}
+
+// MachineDescription describes a pipeline, e.g.
+//
+//	{
+//	  "name": "six stage",
+//	  "stages": [
+//	    {"name": "IF", "roles": ["fetch", "predict"]},
+//	    {"name": "ID", "roles": ["read operands", "resolve branches"]},
+//	    {"name": "EX", "roles": ["execute"]},
+//	    {"name": "MA", "roles": ["memory"]},
+//	    {"name": "MB"},
+//	    {"name": "WB", "roles": ["writeback"]}
+//	  ],
+//	  "latencies": {"M": 5}
+//	}
+type MachineDescription struct {
+	Name      string             `json:"name"`
+	Stages    []StageDescription `json:"stages"`
+	Latencies map[string]int     `json:"latencies"` // functional unit latencies
+}
+
+type StageDescription struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// ParseMachineDescription reads a JSON machine description
+func ParseMachineDescription(input io.Reader) (*MachineDescription, error) {
+	d := new(MachineDescription)
+	decoder := json.NewDecoder(input)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(d); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing machine description: %s", err))
+	}
+	return d, nil
+}
+
+// Pipeline builds the stages of the description
+func (d *MachineDescription) Pipeline() ([]PipelineStage, error) {
+	if len(d.Stages) == 0 {
+		return nil, errors.New("Machine description has no stages")
+	}
+	resolves := false
+	for _, sd := range d.Stages {
+		for _, role := range sd.Roles {
+			resolves = resolves || role == RoleResolveBranch
+		}
+	}
+
+	result := make([]PipelineStage, 0, len(d.Stages))
+	names := make(map[string]bool)
+	for n, sd := range d.Stages {
+		if sd.Name == "" {
+			return nil, errors.New(fmt.Sprintf("Stage %d has no name", n+1))
+		}
+		if names[sd.Name] {
+			return nil, errors.New(fmt.Sprintf("Duplicate stage %s", sd.Name))
+		}
+		names[sd.Name] = true
+		roles := make(map[string]bool)
+		for _, role := range sd.Roles {
+			if _, ok := roleHooks[role]; ok == false {
+				return nil, errors.New(fmt.Sprintf("Unknown role %q of stage %s", role, sd.Name))
+			}
+			roles[role] = true
+		}
+		if roles[RoleReadOperands] && resolves == false {
+			roles[RoleResolveBranch] = true
+		}
+		if roles[RoleExecute] {
+			if len(roles) > 1 {
+				return nil, errors.New(fmt.Sprintf("Stage %s executes and can have no other role", sd.Name))
+			}
+			result = append(result, &EX{name: sd.Name})
+			continue
+		}
+		if roles[RoleWriteBack] && n != len(d.Stages)-1 {
+			return nil, errors.New(fmt.Sprintf("Stage %s writes back and must be the last stage", sd.Name))
+		}
+		result = append(result, &CustomStage{name: sd.Name, roles: roles})
+	}
+	return result, nil
+}
+
+// WithMachineDescription builds the pipeline and sets the functional unit
+// latencies from a machine description
+func WithMachineDescription(d *MachineDescription) Option {
+	return func(c *config) error {
+		stages, err := d.Pipeline()
+		if err != nil {
+			return err
+		}
+		if err := WithPipeline(stages...)(c); err != nil {
+			return err
+		}
+		for unit, cycles := range d.Latencies {
+			if err := WithLatency(unit, cycles)(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// CustomStage
+/////////////////////////////////////////////////////////////////////////////
+
+// CustomStage is a stage of a machine description, running the hooks of its
+// roles in pipeline order
+type CustomStage struct {
+	stage
+	name  string
+	roles map[string]bool
+}
+
+func (s CustomStage) String() string { return s.name }
+
+func (s *CustomStage) hooks() []string {
+	result := make([]string, 0)
+	for _, hook := range stageOrder {
+		for role := range s.roles {
+			if indexOf(roleHooks[role], hook) >= 0 {
+				result = append(result, hook)
+			}
+		}
+	}
+	return result
+}
+
+// Step fetches into an empty slot. The fetch hooks of a fetching stage run
+// once, as the instruction is fetched, so that an instruction held by a
+// stall is only decoded again.
+func (s *CustomStage) Step() error {
+	fetched := false
+	if s.roles[RoleFetch] && s.instruction == nil {
+		fetched = s.fetch(s)
+	}
+	if s.instruction == nil {
+		return nil
+	}
+	i := s.instruction
+
+	named := map[string]func() error{
+		"IF1":     i.IF1,
+		"IF2":     i.IF2,
+		"IF3":     i.IF3,
+		"ID":      func() error { return runHooks(i.ID, s.reserve) },
+		"Resolve": i.Resolve,
+		"MEM1":    i.MEM1,
+		"MEM2":    i.MEM2,
+		"MEM3":    i.MEM3,
+	}
+	fetching, hooks := make([]func() error, 0), make([]func() error, 0)
+	for _, hook := range s.hooks() {
+		f, ok := named[hook]
+		switch {
+		case ok == false:
+		case s.roles[RoleFetch] && indexOf(stageOrder, hook) < indexOf(stageOrder, "ID"):
+			if fetched {
+				fetching = append(fetching, f)
+			}
+		default:
+			hooks = append(hooks, f)
+		}
+	}
+	// a branch resolving or flushing from fetch takes effect with the hooks
+	// after decode
+	fetchResult := runHooks(fetching...)
+	if fetchResult != nil && fetchResult != BranchResolving && fetchResult != FlushPipeline {
+		return fetchResult
+	}
+	if s.roles[RoleReadOperands] {
+		operands, err := s.cpu.Pipeline.Hazards.Decode(i)
+		if err != nil {
+			return err
+		}
+		s.cpu.operands = operands
+		defer func() { s.cpu.operands = nil }()
+	}
+	hooks = append([]func() error{func() error { return fetchResult }}, hooks...)
+	if err := runHooks(hooks...); err != nil {
+		return err
+	}
+	if s.roles[RoleWriteBack] {
+		s.writeBack()
+	}
+	return nil
+}
@@ -1,25 +1,261 @@
 package mips
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 )
 
 type Word uint64
 
-const memorySize = 992 // Size of memory in words
+const (
+	WordSize          = 8                    // bytes in a Word
+	DefaultMemorySize = 992 * WordSize       // bytes
+	MaxMemorySize     = Word(math.MaxUint64) // the whole address space, for sparse memory
+	sparsePageSize    = 4096
+)
+
+// Byte order of multi-byte memory accesses
+type Endianness int
+
+const (
+	BigEndian Endianness = iota
+	LittleEndian
+)
+
+var (
+	AddressOutOfRange = errors.New("Address out of range")
+)
+
+// Memory is byte addressable. Accesses of 2, 4 and 8 bytes must be aligned
+// to their size and fall below Size().
+type Memory interface {
+	// Load reads size bytes starting at address, zero-extended to a Word
+	Load(address Word, size int) (Word, error)
+	// Store writes the low size bytes of value starting at address
+	Store(address Word, size int, value Word) error
+	// CheckAccess returns the *MemoryFault an access would raise, if any
+	CheckAccess(address Word, size int) error
+	// Word returns the aligned doubleword containing address, or 0
+	Word(address Word) Word
+	Size() Word
+	SetEndianness(e Endianness)
+	String() string
+}
+
+// AddressError is raised by a misaligned memory access
+type AddressError struct {
+	Address Word
+	Size    int
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("Address error: %d byte access at %s is not aligned", e.Size, e.Address)
+}
+
+// MemoryFault reports an access that could not be performed, either because
+// it was misaligned (an *AddressError) or out of range (AddressOutOfRange).
+// Memory fills in the address and cause, the pipeline the instruction, cycle
+// and stage in which the access was attempted.
+type MemoryFault struct {
+	Address     Word
+	Size        int
+	Instruction *ExecutedInstruction
+	Cycle       int
+	Stage       string
+	Err         error
+}
+
+func (f *MemoryFault) Error() string {
+	if f.Instruction == nil {
+		return fmt.Sprintf("Memory fault: %s", f.Err)
+	}
+	return fmt.Sprintf("Memory fault in %s of %s (cycle %d): %s", f.Stage, f.Instruction.Instruction, f.Cycle, f.Err)
+}
+
+func (f *MemoryFault) Unwrap() error {
+	return f.Err
+}
 
-type Memory [memorySize]Word
+// executionError fills in where a memory fault raised by i was attempted,
+// other errors are wrapped
+func executionError(err error, i *ExecutedInstruction, stage string, cycle int) error {
+	var fault *MemoryFault
+	if errors.As(err, &fault) {
+		fault.Instruction, fault.Cycle, fault.Stage = i, cycle, stage
+		return fault
+	}
+	return fmt.Errorf("Error while executing %s: %w", i, err)
+}
 
 func (w Word) String() string {
 	return fmt.Sprintf("%#x", uint64(w))
 }
 
-func (r Memory) String() string {
+// Float interprets the word as an IEEE 754 double
+func (w Word) Float() float64 {
+	return math.Float64frombits(uint64(w))
+}
+
+func FloatWord(f float64) Word {
+	return Word(math.Float64bits(f))
+}
+
+// byteStorage is implemented by the memory backends
+type byteStorage interface {
+	byteAt(address Word) byte
+	setByte(address Word, b byte)
+	// regions returns the [start, end) address ranges that may hold data
+	regions() [][2]Word
+}
+
+// memory implements sized, ordered accesses on top of a backend
+type memory struct {
+	storage    byteStorage
+	size       Word
+	endianness Endianness
+}
+
+func (m *memory) Size() Word {
+	return m.size
+}
+
+func (m *memory) SetEndianness(e Endianness) {
+	m.endianness = e
+}
+
+// CheckAccess returns a *MemoryFault if an access is misaligned or falls
+// outside of memory. Negative offsets wrap around to very large addresses.
+func (m *memory) CheckAccess(address Word, size int) error {
+	fault := &MemoryFault{Address: address, Size: size}
+	switch {
+	case address%Word(size) != 0:
+		fault.Err = &AddressError{Address: address, Size: size}
+	case m.size == MaxMemorySize:
+		return nil
+	case m.size < Word(size) || address > m.size-Word(size):
+		fault.Err = AddressOutOfRange
+	default:
+		return nil
+	}
+	return fault
+}
+
+func (m *memory) Load(address Word, size int) (Word, error) {
+	if err := m.CheckAccess(address, size); err != nil {
+		return 0, err
+	}
+	value := Word(0)
+	for n := 0; n < size; n++ {
+		value |= Word(m.storage.byteAt(address+Word(m.byteIndex(n, size)))) << (8 * uint(n))
+	}
+	return value, nil
+}
+
+func (m *memory) Store(address Word, size int, value Word) error {
+	if err := m.CheckAccess(address, size); err != nil {
+		return err
+	}
+	for n := 0; n < size; n++ {
+		m.storage.setByte(address+Word(m.byteIndex(n, size)), byte(value>>(8*uint(n))))
+	}
+	return nil
+}
+
+// byteIndex returns the offset within an access of the nth least
+// significant byte
+func (m *memory) byteIndex(n, size int) int {
+	if m.endianness == BigEndian {
+		return size - 1 - n
+	}
+	return n
+}
+
+func (m *memory) Word(address Word) Word {
+	value, _ := m.Load(address-address%WordSize, WordSize)
+	return value
+}
+
+func (m *memory) String() string {
 	result := ""
-	for i := 0; i < memorySize; i++ {
-		if r[i] != 0 {
-			result += fmt.Sprintf("%#x = %d\n", i, r[i])
+	for _, region := range m.storage.regions() {
+		// compare offsets, the last page of the address space ends at 0
+		for i := region[0]; i-region[0] < region[1]-region[0]; i += WordSize {
+			if value := m.Word(i); value != 0 {
+				result += fmt.Sprintf("%#x = %d\n", uint64(i), value)
+			}
 		}
 	}
 	return result
 }
+
+// DenseMemory backs every address with a byte slice
+type DenseMemory struct {
+	memory
+	bytes []byte
+}
+
+// NewDenseMemory returns big endian memory of size bytes
+func NewDenseMemory(size Word) *DenseMemory {
+	m := &DenseMemory{bytes: make([]byte, size)}
+	m.memory = memory{storage: m, size: size}
+	return m
+}
+
+func (m *DenseMemory) byteAt(address Word) byte {
+	return m.bytes[address]
+}
+
+func (m *DenseMemory) setByte(address Word, b byte) {
+	m.bytes[address] = b
+}
+
+func (m *DenseMemory) regions() [][2]Word {
+	return [][2]Word{{0, m.size - m.size%WordSize}}
+}
+
+// SparseMemory allocates pages on first write, so programs can place data
+// anywhere in a large address space
+type SparseMemory struct {
+	memory
+	pages map[Word]*[sparsePageSize]byte
+}
+
+// NewSparseMemory returns big endian memory of size bytes, pass
+// MaxMemorySize for the whole address space
+func NewSparseMemory(size Word) *SparseMemory {
+	m := &SparseMemory{pages: make(map[Word]*[sparsePageSize]byte)}
+	m.memory = memory{storage: m, size: size}
+	return m
+}
+
+func (m *SparseMemory) byteAt(address Word) byte {
+	if page, ok := m.pages[address/sparsePageSize]; ok {
+		return page[address%sparsePageSize]
+	}
+	return 0
+}
+
+func (m *SparseMemory) setByte(address Word, b byte) {
+	page, ok := m.pages[address/sparsePageSize]
+	if !ok {
+		page = new([sparsePageSize]byte)
+		m.pages[address/sparsePageSize] = page
+	}
+	page[address%sparsePageSize] = b
+}
+
+func (m *SparseMemory) regions() [][2]Word {
+	numbers := make([]Word, 0, len(m.pages))
+	for n := range m.pages {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(a, b int) bool { return numbers[a] < numbers[b] })
+
+	result := make([][2]Word, 0, len(numbers))
+	for _, n := range numbers {
+		result = append(result, [2]Word{n * sparsePageSize, n*sparsePageSize + sparsePageSize})
+	}
+	return result
+}
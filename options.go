@@ -0,0 +1,348 @@
+package mips
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Option configures a CPU created by NewCPU
+type Option func(c *config) error
+
+// config collects the options, it is validated as a whole before the CPU is
+// built so that invalid combinations are rejected up front
+type config struct {
+	stages       []PipelineStage
+	branchPolicy BranchPolicy
+	predictor    BranchPredictor
+	btbEntries   int
+	btbWays      int
+	rasDepth     int
+	rasOverflow  RASOverflow
+	delaySlots   int
+	width        int
+	robSize      int
+	renaming     int // physical registers, 0 without renaming
+	engine       func(cpu *CPU) Engine
+	engineName   string
+	forwarding   ForwardingPath
+	memory       Memory
+	memorySize   Word
+	latencies    map[string]int
+	trace        io.Writer
+}
+
+// canonical hook order, and the hooks an instruction can not do without
+var (
+	stageOrder     = []string{"IF1", "IF2", "IF3", "ID", "Resolve", "EX", "MEM1", "MEM2", "MEM3", "WB"}
+	requiredStages = []string{"IF1", "ID", "Resolve", "EX", "MEM1", "MEM3", "WB"}
+)
+
+// WithPipeline replaces the default nine stages, e.g. with
+// FiveStagePipeline(). Stages must keep the IF1..WB order, IF2, IF3 and MEM2
+// may be left out.
+func WithPipeline(stages ...PipelineStage) Option {
+	return func(c *config) error {
+		if len(stages) == 0 {
+			return errors.New("Must have at least one stage")
+		}
+		c.stages = stages
+		return nil
+	}
+}
+
+// WithBranchPolicy sets how branches are handled
+func WithBranchPolicy(policy BranchPolicy) Option {
+	return func(c *config) error {
+		switch policy {
+		case BranchPolicyFlush, BranchPolicyPredictTaken, BranchPolicyPredictNotTaken, BranchPolicyPredictDynamic:
+		default:
+			return errors.New(fmt.Sprintf("Unknown branch policy %d", policy))
+		}
+		c.branchPolicy = policy
+		return nil
+	}
+}
+
+// WithBranchPredictor predicts branches dynamically with p, e.g.
+// NewTwoBitPredictor(64)
+func WithBranchPredictor(p BranchPredictor) Option {
+	return func(c *config) error {
+		if p == nil {
+			return errors.New("Branch predictor must not be nil")
+		}
+		c.branchPolicy = BranchPolicyPredictDynamic
+		c.predictor = p
+		return nil
+	}
+}
+
+// WithBTB adds a branch target buffer of entries entries in sets of ways,
+// e.g. WithBTB(64, 2). Taken branches are then predicted in IF1 and only if
+// their target is cached.
+func WithBTB(entries, ways int) Option {
+	return func(c *config) error {
+		if entries < 1 || ways < 1 || entries%ways != 0 {
+			return errors.New(fmt.Sprintf("Invalid BTB of %d entries in sets of %d", entries, ways))
+		}
+		c.btbEntries, c.btbWays = entries, ways
+		return nil
+	}
+}
+
+// WithRAS adds a return address stack of depth entries, overflow decides
+// what a call does when it is full
+func WithRAS(depth int, overflow RASOverflow) Option {
+	return func(c *config) error {
+		if depth < 1 {
+			return errors.New("Return address stack must hold at least one address")
+		}
+		if overflow != RASOverwrite && overflow != RASDiscard {
+			return errors.New(fmt.Sprintf("Unknown return address stack overflow %d", overflow))
+		}
+		c.rasDepth, c.rasOverflow = depth, overflow
+		return nil
+	}
+}
+
+// WithDelaySlots executes the n instructions after every branch whether it
+// is taken or not, as classic MIPS does with n = 1
+func WithDelaySlots(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return errors.New("Number of delay slots must not be negative")
+		}
+		c.delaySlots = n
+		return nil
+	}
+}
+
+// WithIssueWidth makes the pipeline superscalar: every stage holds up to n
+// instructions, IF1 fetches and ID issues up to n per cycle and the integer
+// unit accepts n per cycle. The instructions issued together may contain
+// one memory access and one branch and must not depend on one another.
+func WithIssueWidth(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return errors.New("Issue width must be at least 1")
+		}
+		c.width = n
+		return nil
+	}
+}
+
+// WithTomasulo executes out of order with Tomasulo's algorithm instead of
+// the pipeline, with the given number of reservation stations per class,
+// the others as in DefaultStations
+func WithTomasulo(stations map[string]int) Option {
+	return func(c *config) error {
+		if c.engineName == "Scoreboard" {
+			return errors.New("WithTomasulo and WithScoreboard are mutually exclusive")
+		}
+		for class, n := range stations {
+			if _, ok := DefaultStations[class]; ok == false {
+				return errors.New(fmt.Sprintf("Unknown reservation station class %s", class))
+			}
+			if n < 1 {
+				return errors.New(fmt.Sprintf("Must have at least one %s reservation station", class))
+			}
+		}
+		c.engine = func(cpu *CPU) Engine { return NewTomasulo(cpu, stations, c.robSize) }
+		c.engineName = "Tomasulo"
+		return nil
+	}
+}
+
+// WithScoreboard executes out of order with a CDC 6600 style scoreboard
+// instead of the pipeline, with the given number of functional units per
+// class, the others as in DefaultScoreboardUnits
+func WithScoreboard(units map[string]int) Option {
+	return func(c *config) error {
+		if c.engineName == "Tomasulo" {
+			return errors.New("WithTomasulo and WithScoreboard are mutually exclusive")
+		}
+		for class, n := range units {
+			if _, ok := DefaultScoreboardUnits[class]; ok == false {
+				return errors.New(fmt.Sprintf("Unknown functional unit %s", class))
+			}
+			if n < 1 {
+				return errors.New(fmt.Sprintf("Must have at least one %s unit", class))
+			}
+		}
+		c.engine = func(cpu *CPU) Engine { return NewScoreboard(cpu, units) }
+		c.engineName = "Scoreboard"
+		return nil
+	}
+}
+
+// WithReorderBuffer adds a reorder buffer of size entries to the Tomasulo
+// engine: instructions issue past predicted branches and commit in order
+func WithReorderBuffer(size int) Option {
+	return func(c *config) error {
+		if size < 1 {
+			return errors.New("Reorder buffer must have at least one entry")
+		}
+		c.robSize = size
+		return nil
+	}
+}
+
+// WithRenaming renames R1-R31 onto n physical registers in ID, removing
+// the WAW and WAR hazards between the general purpose registers. The first
+// 32 physical registers hold the initial values of R0-R31, so n must be
+// larger.
+func WithRenaming(n int) Option {
+	return func(c *config) error {
+		if n <= 32 {
+			return errors.New("Renaming requires more than 32 physical registers")
+		}
+		c.renaming = n
+		return nil
+	}
+}
+
+// WithForwarding enables or disables all forwarding paths, the split-cycle
+// register file (ForwardWBtoID) is kept when disabled
+func WithForwarding(enabled bool) Option {
+	return func(c *config) error {
+		c.forwarding = ForwardRegisterFile
+		if enabled {
+			c.forwarding = ForwardAll
+		}
+		return nil
+	}
+}
+
+// WithForwardingPaths enables the given forwarding paths only, e.g.
+// ForwardEXtoEX|ForwardWBtoID
+func WithForwardingPaths(paths ForwardingPath) Option {
+	return func(c *config) error {
+		if paths&^ForwardAll != 0 {
+			return errors.New(fmt.Sprintf("Unknown forwarding paths %d", paths))
+		}
+		c.forwarding = paths
+		return nil
+	}
+}
+
+// WithMemory replaces the default dense memory
+func WithMemory(m Memory) Option {
+	return func(c *config) error {
+		if m == nil {
+			return errors.New("Memory must not be nil")
+		}
+		c.memory = m
+		return nil
+	}
+}
+
+// WithMemorySize uses dense memory of size bytes
+func WithMemorySize(size Word) Option {
+	return func(c *config) error {
+		if size < WordSize {
+			return errors.New("Memory must hold at least one word")
+		}
+		c.memorySize = size
+		return nil
+	}
+}
+
+// WithLatency sets the latency in cycles of the named functional unit
+// ("A", "M" or "DIV")
+func WithLatency(unit string, cycles int) Option {
+	return func(c *config) error {
+		if cycles < 1 {
+			return errors.New(fmt.Sprintf("Latency of %s must be at least one cycle", unit))
+		}
+		if c.latencies == nil {
+			c.latencies = make(map[string]int)
+		}
+		c.latencies[unit] = cycles
+		return nil
+	}
+}
+
+// WithTrace writes the pipeline state to w after every cycle
+func WithTrace(w io.Writer) Option {
+	return func(c *config) error {
+		c.trace = w
+		return nil
+	}
+}
+
+func (c *config) validate() error {
+	if c.memory != nil && c.memorySize != 0 {
+		return errors.New("WithMemory and WithMemorySize are mutually exclusive")
+	}
+
+	names := make(map[string]bool)
+	next := 0
+	for _, stage := range c.stages {
+		for _, name := range stageHooks(stage) {
+			if names[name] {
+				return errors.New(fmt.Sprintf("Duplicate stage %s", name))
+			}
+			names[name] = true
+			position := indexOf(stageOrder, name)
+			if position < 0 {
+				return errors.New(fmt.Sprintf("Unknown stage %s", name))
+			}
+			if position < next {
+				return errors.New(fmt.Sprintf("Stage %s out of order", name))
+			}
+			next = position + 1
+		}
+	}
+	for _, name := range requiredStages {
+		if names[name] == false {
+			return errors.New(fmt.Sprintf("Pipeline must have a %s stage", name))
+		}
+	}
+	// predictions are made in IF2
+	if c.branchPolicy != BranchPolicyFlush && names["IF2"] == false {
+		return errors.New("Branch prediction requires an IF2 stage")
+	}
+	if c.branchPolicy == BranchPolicyPredictDynamic && c.predictor == nil {
+		return errors.New("Dynamic branch prediction requires a predictor")
+	}
+	if c.btbEntries != 0 && (c.branchPolicy == BranchPolicyFlush || c.branchPolicy == BranchPolicyPredictNotTaken) {
+		return errors.New("A BTB requires a policy predicting branches taken")
+	}
+	if c.rasDepth != 0 && c.branchPolicy == BranchPolicyFlush {
+		return errors.New("A return address stack requires branch prediction")
+	}
+
+	// without a reorder buffer the engines issue no instructions past an
+	// unresolved branch
+	if c.robSize != 0 && c.engineName != "Tomasulo" {
+		return errors.New("A reorder buffer requires WithTomasulo")
+	}
+	if c.engine != nil {
+		switch {
+		case c.robSize == 0 && (c.branchPolicy != BranchPolicyFlush || c.btbEntries != 0 || c.rasDepth != 0):
+			return errors.New(fmt.Sprintf("%s does not predict branches", c.engineName))
+		case c.delaySlots != 0:
+			return errors.New(fmt.Sprintf("%s has no delay slots", c.engineName))
+		case c.width > 1:
+			return errors.New(fmt.Sprintf("%s issues one instruction per cycle", c.engineName))
+		case c.renaming != 0:
+			return errors.New(fmt.Sprintf("%s does not rename onto physical registers", c.engineName))
+		}
+	}
+
+	for unit := range c.latencies {
+		if unit != "A" && unit != "M" && unit != "DIV" {
+			return errors.New(fmt.Sprintf("Unknown functional unit %s", unit))
+		}
+	}
+	return nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
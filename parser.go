@@ -87,11 +87,14 @@ func (mp *cpuParser) Parse() (m *CPU, err error) {
 				if err != nil {
 					return nil, err
 				}
-				intVal, err := strconv.Atoi(val)
+				if operand.Type != operandTypeNormal {
+					return nil, mp.parseError("invalid register")
+				}
+				value, err := parseValue(val)
 				if err != nil {
 					return nil, err
 				}
-				m.Registers.Set(operand.Register, Word(intVal))
+				m.Registers.Set(operand.Register, value)
 			}
 		case stateMemory:
 			if s, _ := mp.next(); s == "CODE" {
@@ -107,11 +110,13 @@ func (mp *cpuParser) Parse() (m *CPU, err error) {
 				if err != nil {
 					return nil, err
 				}
-				intVal, err := strconv.Atoi(val)
+				value, err := parseValue(val)
 				if err != nil {
 					return nil, err
 				}
-				m.Ram[memPos] = Word(intVal)
+				if err := m.Ram.Store(Word(memPos), WordSize, value); err != nil {
+					return nil, mp.parseError(err.Error())
+				}
 			}
 		case stateCode:
 			if _, e := mp.next(); e == io.EOF || mp.current() == "" {
@@ -135,12 +140,16 @@ func (mp *cpuParser) Parse() (m *CPU, err error) {
 	return m, nil
 }
 
-func ParseCPUString(input string) (*CPU, error) {
-	return ParseCPU(strings.NewReader(input))
+func ParseCPUString(input string, opts ...Option) (*CPU, error) {
+	return ParseCPU(strings.NewReader(input), opts...)
 }
 
-func ParseCPU(input io.Reader) (*CPU, error) {
-	p, err := newCPUParser(NewCPU(), input)
+func ParseCPU(input io.Reader, opts ...Option) (*CPU, error) {
+	cpu, err := NewCPU(opts...)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newCPUParser(cpu, input)
 	if err != nil {
 		return nil, err
 	}
@@ -158,13 +167,9 @@ func ParseOperand(s string) (o Operand, err error) {
 		if err != nil {
 			return o, err
 		}
-		//R4
-	} else if s[0] == 'R' {
-		iVal, err := strconv.Atoi(s[1:])
-		if err != nil {
-			return o, err
-		}
-		o.Register = Register(iVal)
+		//R4, F2
+	} else if register, ok := parseRegister(s); ok {
+		o.Register = register
 		o.Type = operandTypeNormal
 		//16(R2)
 	} else if strings.Index(s, "(") != -1 && strings.Index(s, ")") != -1 {
@@ -180,6 +185,11 @@ func ParseOperand(s string) (o Operand, err error) {
 		}
 		o.Register = Register(iVal)
 		o.Type = operandTypeOffset
+		//4, shift amounts may omit the #
+	} else if iVal, convErr := strconv.Atoi(s); convErr == nil {
+		o.Offset = iVal
+		o.Register = None
+		o.Type = operandTypeImmediate
 		// Loop
 	} else {
 		o.Type = operandTypeLabel
@@ -187,6 +197,39 @@ func ParseOperand(s string) (o Operand, err error) {
 	return o, err
 }
 
+// operandValidator is implemented by instructions that restrict the kinds of
+// operands they accept, such as shifts
+type operandValidator interface {
+	validateOperands() error
+}
+
+// parseRegister parses integer (R0-R31) and floating point (F0-F31)
+// register names
+func parseRegister(s string) (Register, bool) {
+	if len(s) < 2 || (s[0] != 'R' && s[0] != 'F') {
+		return None, false
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil || n < 0 || n > 31 {
+		return None, false
+	}
+	if s[0] == 'F' {
+		return F0 + Register(n), true
+	}
+	return Register(n), true
+}
+
+// parseValue parses an initial register or memory value, values containing
+// a decimal point or exponent are stored as doubles
+func parseValue(s string) (Word, error) {
+	if strings.ContainsAny(s, ".eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		return FloatWord(f), err
+	}
+	i, err := strconv.Atoi(s)
+	return Word(i), err
+}
+
 type instructionParser struct {
 	line        string
 	instruction *Instruction
@@ -258,7 +301,12 @@ func (ip *instructionParser) Parse() (i Instruction, err error) {
 			}
 			i.SetDestination(destination)
 			parts = parts[1:]
-			ip.state = stateOperand1
+			if len(parts) > 0 {
+				ip.state = stateOperand1
+			} else {
+				// jumps take a single operand
+				ip.state = stateFinished
+			}
 
 		case stateOperand1:
 			parts[0] = strings.Trim(parts[0], ",")
@@ -297,6 +345,11 @@ func (ip *instructionParser) Parse() (i Instruction, err error) {
 			}
 		}
 	}
+	if v, ok := i.(operandValidator); ok {
+		if err := v.validateOperands(); err != nil {
+			return nil, err
+		}
+	}
 	return i, nil
 }
 
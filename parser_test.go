@@ -40,7 +40,7 @@ R1 42
 R0 9
 R7 13
 MEMORY
-42 31337
+40 31337
 CODE`,
 }
 
@@ -48,7 +48,7 @@ func testCPUsEqual(m1, m2 *CPU) bool {
 	if m1 == nil && m2 == nil {
 		return true
 	}
-	stateAndRamEqual := m2.Registers == m2.Registers && m1.Ram == m2.Ram
+	stateAndRamEqual := m2.Registers == m2.Registers && m1.Ram.String() == m2.Ram.String()
 	return stateAndRamEqual && m1.InstructionCache.Equals(m2.InstructionCache)
 }
 
@@ -57,7 +57,7 @@ func TestParsingSmallest(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if testCPUsEqual(cpu, NewCPU()) == false {
+	if testCPUsEqual(cpu, newTestCPU(t)) == false {
 		t.Error("Parsing of smallest doesn't match empty cpu")
 	}
 }
@@ -92,8 +92,8 @@ func TestParsingRegistersAndMemorySet(t *testing.T) {
 	if cpu.Registers.Get(R0) != 0 {
 		t.Error("R0 != 0")
 	}
-	if cpu.Ram[42] != 31337 {
-		t.Error("Mem[42] != 31337")
+	if cpu.Ram.Word(40) != 31337 {
+		t.Error("Mem[40] != 31337")
 	}
 }
 
@@ -102,7 +102,7 @@ func TestParsingProvided0(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if testCPUsEqual(cpu, NewCPU()) == true {
+	if testCPUsEqual(cpu, newTestCPU(t)) == true {
 		t.Error("Parsing provided example 0 produced empty cpu")
 	}
 }
@@ -112,7 +112,7 @@ func TestParsingProvided1(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if testCPUsEqual(cpu, NewCPU()) == true {
+	if testCPUsEqual(cpu, newTestCPU(t)) == true {
 		t.Error("Parsing provided example 1 produced empty cpu")
 	}
 }
@@ -122,7 +122,7 @@ func TestParsingProvided2(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if testCPUsEqual(cpu, NewCPU()) == true {
+	if testCPUsEqual(cpu, newTestCPU(t)) == true {
 		t.Error("Parsing provided example 2 produced empty cpu")
 	}
 }
@@ -139,6 +139,8 @@ Next: LD    R6,    0(R5)
       DADD  R4,    R2,    R3
       SD    0(R5), R4
       DADDI R1,    R1,    #-8
+      J     Loop
+      JALR  R2,    R3
 `
 
 func TestInstructionParsing(t *testing.T) {
@@ -155,6 +157,8 @@ LD R6 0(R5) (label: Next)
 DADD R4 R2 R3
 SD 0(R5) R4
 DADDI R1 R1 #-8
+J Loop
+JALR R2 R3
 `
 	for _, line := range strings.Split(strings.TrimSpace(INSTRUCTION_TESTS), "\n") {
 		i, err := ParseInstruction(strings.NewReader(line))
@@ -167,3 +171,221 @@ DADDI R1 R1 #-8
 		t.Errorf("Expected != Actual: '%s' != '%s'", expected, actual)
 	}
 }
+
+func TestShiftAmountParsing(t *testing.T) {
+	i, err := ParseInstruction(strings.NewReader("DSLL R1, R2, 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.OperandB().Type != operandTypeImmediate || i.OperandB().Offset != 3 {
+		t.Errorf("shift amount parsed as %s", i.OperandB())
+	}
+
+	for _, line := range []string{
+		"DSLL   R1, R2, -1",
+		"DSRA   R1, R2, #32",
+		"DSRL32 R1, R2, R3",
+		"DSRAV  R1, R2, #4",
+	} {
+		if _, err := ParseInstruction(strings.NewReader(line)); err == nil {
+			t.Errorf("%s: expected error", line)
+		}
+	}
+}
+
+func TestFloatingPointParsing(t *testing.T) {
+	cpu, err := ParseCPUString(`REGISTERS
+F2 1.5
+F31 -2e3
+MEMORY
+8 0.25
+CODE
+      L.D   F4, 0(R1)
+      ADD.D F6, F4, F2
+Func: S.D   F6, 8(R1)
+      JAL   Func
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(F2).Float() != 1.5 || cpu.Registers.Get(F31).Float() != -2000 {
+		t.Error("FP registers not set")
+	}
+	if cpu.Ram.Word(8).Float() != 0.25 {
+		t.Error("FP memory not set")
+	}
+	if op := cpu.InstructionCache[1].OperandA(); op.Register != F4 || op.String() != "F4" {
+		t.Errorf("F4 parsed as %s", op)
+	}
+	if op := cpu.InstructionCache[3].Destination(); op.Type != operandTypeLabel {
+		t.Errorf("label Func parsed as %s", op)
+	}
+}
+
+func TestParsingMisalignedMemory(t *testing.T) {
+	_, err := ParseCPUString(`REGISTERS
+MEMORY
+4 1
+CODE`)
+	if err == nil {
+		t.Error("expected error for misaligned memory initialization")
+	}
+}
+
+func TestParsingMemoryOutOfRange(t *testing.T) {
+	_, err := ParseCPUString(`REGISTERS
+MEMORY
+8000 1
+CODE`)
+	if err == nil {
+		t.Error("expected error for memory initialization out of range")
+	}
+}
+
+func TestMachineDescription(t *testing.T) {
+	d, err := ParseMachineDescription(testFile("machine-seven.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, program := range CPU_TESTS {
+		for _, policy := range []BranchPolicy{BranchPolicyFlush, BranchPolicyPredictTaken, BranchPolicyPredictNotTaken} {
+			expected, err := ParseCPUString(program, WithBranchPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpu, err := ParseCPUString(program, WithMachineDescription(d), WithBranchPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := expected.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if err := cpu.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if cpu.String() != expected.String() {
+				t.Errorf("%s: '%s' != '%s'", name, cpu, expected)
+			}
+		}
+	}
+
+	cpu, err := ParseCPUString(CPU_TESTS["branching_simple"], WithMachineDescription(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Unit("M").Latency != 5 || cpu.Unit("DIV").Latency != 12 {
+		t.Error("latencies not applied")
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	// the branch resolves in BR, a cycle after reading R1 in RF
+	branch := cpu.Instructions[1]
+	if branch.Stages["BR"] != branch.Stages["RF"]+1 || branch.Stages["DF"] == 0 {
+		t.Errorf("unexpected branch timing %v", branch.Cycles)
+	}
+	if fields := strings.Fields(cpu.RenderTimingForCycle(2)); fields[1] != "IS" || fields[2] != "IF" {
+		t.Errorf("unexpected timing for cycle 2: %v", fields)
+	}
+}
+
+// a stage both fetching and reading operands decodes the instruction it
+// holds again after a stall
+func TestFetchDecodeStage(t *testing.T) {
+	d, err := ParseMachineDescription(strings.NewReader(`{"stages": [
+		{"name": "FD", "roles": ["fetch", "predict", "read operands"]},
+		{"name": "EX", "roles": ["execute"]},
+		{"name": "MEM", "roles": ["memory"]},
+		{"name": "WB", "roles": ["writeback"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu, err := ParseCPUString(`REGISTERS
+R1 2
+MEMORY
+CODE
+      DADDI R2, R1, #1
+      DADDI R3, R2, #1
+      DADDI R4, R3, #1
+`, WithMachineDescription(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Run(100); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Registers.Get(R3) != 4 || cpu.Registers.Get(R4) != 5 {
+		t.Errorf("unexpected result\n%s", cpu)
+	}
+	// stalled in FD until the producer has written back
+	timing := cpu.RenderTiming()
+	if strings.Contains(timing, "c#2   EX    (s)   .") == false || strings.Contains(timing, "c#4   WB    FD    .") == false {
+		t.Errorf("unexpected timing\n%s", timing)
+	}
+
+	for name, program := range CPU_TESTS {
+		for _, policy := range []BranchPolicy{BranchPolicyFlush, BranchPolicyPredictTaken, BranchPolicyPredictNotTaken} {
+			expected, err := ParseCPUString(program, WithBranchPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cpu, err := ParseCPUString(program, WithMachineDescription(d), WithBranchPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := expected.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if err := cpu.Run(1000); err != nil {
+				t.Fatal(name, err)
+			}
+			if cpu.String() != expected.String() {
+				t.Errorf("%s: '%s' != '%s'", name, cpu, expected)
+			}
+			cpu.RenderTiming() // must not panic
+		}
+	}
+}
+
+func TestInvalidMachineDescription(t *testing.T) {
+	for _, description := range []string{
+		`{"stages": []}`,
+		`{"stages": [{"name": "IF", "roles": ["fetch"]}], "unknown": 1}`,
+		`{"stages": [{"name": "IF", "roles": ["fetch", "decode"]}]}`,
+		`{"stages": [{"roles": ["fetch"]}]}`,
+		// execute can not share a stage
+		`{"stages": [{"name": "IF", "roles": ["fetch"]}, {"name": "ID", "roles": ["read operands"]},
+		  {"name": "EX", "roles": ["execute", "memory"]}, {"name": "WB", "roles": ["writeback"]}]}`,
+		// writeback must be last
+		`{"stages": [{"name": "IF", "roles": ["fetch"]}, {"name": "ID", "roles": ["read operands"]},
+		  {"name": "EX", "roles": ["execute"]}, {"name": "WB", "roles": ["memory", "writeback"]}, {"name": "X"}]}`,
+		// branches can not resolve before reading their operands
+		`{"stages": [{"name": "IF", "roles": ["fetch", "resolve branches"]}, {"name": "ID", "roles": ["read operands"]},
+		  {"name": "EX", "roles": ["execute"]}, {"name": "WB", "roles": ["memory", "writeback"]}]}`,
+		// missing memory stage
+		`{"stages": [{"name": "IF", "roles": ["fetch"]}, {"name": "ID", "roles": ["read operands"]},
+		  {"name": "EX", "roles": ["execute"]}, {"name": "WB", "roles": ["writeback"]}]}`,
+		`{"stages": [{"name": "IF", "roles": ["fetch"]}, {"name": "ID", "roles": ["read operands"]},
+		  {"name": "EX", "roles": ["execute"]}, {"name": "WB", "roles": ["memory", "writeback"]}],
+		  "latencies": {"EX": 2}}`,
+	} {
+		d, err := ParseMachineDescription(strings.NewReader(description))
+		if err == nil {
+			_, err = NewCPU(WithMachineDescription(d))
+		}
+		if err == nil {
+			t.Errorf("expected an error for %s", description)
+		}
+	}
+
+	// stages are named uniquely, the timing table is keyed by name
+	d, err := ParseMachineDescription(strings.NewReader(`{"stages": [{"name": "IF", "roles": ["fetch"]},
+	  {"name": "ID", "roles": ["read operands"]}, {"name": "EX", "roles": ["execute"]},
+	  {"name": "EX", "roles": ["memory"]}, {"name": "WB", "roles": ["writeback"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Pipeline(); err == nil || err.Error() != "Duplicate stage EX" {
+		t.Errorf("expected the duplicate stage to be named, got %v", err)
+	}
+}
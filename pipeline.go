@@ -11,16 +11,53 @@ var (
 
 type ExecutedInstruction struct {
 	Instruction
+	Index       int // position in fetch order
 	Stage       PipelineStage
 	Stages      map[string]int // map of Stages to cycle at which that stage was entered
 	Cycles      map[int]string // map of cycles to Stages
 	CycleStart  int
 	CycleFinish int
 	CycleFlush  int
+	Stalls      map[int]*Hazard // cause of each cycle the instruction stalled
+	renamed     []renaming      // physical registers given to the destinations
 }
 
-type Pipeline []PipelineStage
+// Pipeline holds the stages and, from EX onward, the latches between them
+type Pipeline struct {
+	Stages  []PipelineStage
+	Latches []*Latch
+	Hazards *HazardUnit
+}
+
+// Latch is the pipeline register at the output of a stage, e.g. EX/MEM1. It
+// carries the instructions leaving the stage along with their results, the
+// forwarding muxes read from it.
+type Latch struct {
+	Name         string
+	Path         ForwardingPath // the forwarding path reading from the latch
+	Instructions []*ExecutedInstruction
+	stage        PipelineStage
+}
 
+func (l *Latch) String() string {
+	result := l.Name + "["
+	for n, i := range l.Instructions {
+		if n > 0 {
+			result += " "
+		}
+		result += fmt.Sprintf("I#%d", i.Index+1)
+		for _, r := range i.Writes() {
+			if v, ok := i.Result(r); ok {
+				result += fmt.Sprintf(" %s=%d", r, v)
+			}
+		}
+	}
+	return result + "]"
+}
+
+// PipelineStage is a stage holding up to Width instructions in its slots,
+// oldest first. Step works on the selected slot, the pipeline selects each
+// slot in turn.
 type PipelineStage interface {
 	Initialize(cpu *CPU)
 	CPU() *CPU
@@ -31,106 +68,302 @@ type PipelineStage interface {
 	Stalled() bool
 	SetInstruction(instruction *ExecutedInstruction)
 	GetInstruction() *ExecutedInstruction
+	Width() int
+	SetWidth(n int)
+	Select(slot int)
+	Slots() []*ExecutedInstruction
+	SetSlots(instructions []*ExecutedInstruction)
+	Leaving() []*ExecutedInstruction
+	Active() []*ExecutedInstruction
 	Next() PipelineStage
 	Prev() PipelineStage
 	SetNext(PipelineStage)
 	SetPrev(PipelineStage)
 }
 
+// NineStagePipeline returns the stages of the default, deep pipeline
+func NineStagePipeline() []PipelineStage {
+	return []PipelineStage{
+		new(IF1),
+		new(IF2),
+		new(IF3),
+		new(ID),
+		new(EX),
+		new(MEM1),
+		new(MEM2),
+		new(MEM3),
+		new(WB),
+	}
+}
+
+// FiveStagePipeline returns the stages of the classic IF/ID/EX/MEM/WB
+// pipeline
+func FiveStagePipeline() []PipelineStage {
+	return []PipelineStage{
+		new(IF),
+		new(ID),
+		new(EX),
+		new(MEM),
+		new(WB),
+	}
+}
+
 func NewPipeline(cpu *CPU, stages ...PipelineStage) (Pipeline, error) {
-	pipeline := make([]PipelineStage, 0)
+	pipeline := Pipeline{Stages: make([]PipelineStage, 0), Hazards: newHazardUnit(cpu)}
 
+	// latches follow EX, the first one feeds EX→EX forwarding, the others
+	// MEM→EX until the last memory stage
+	path := ForwardingPath(0)
 	for i, stage := range stages {
 		stage.Initialize(cpu)
-		pipeline = append(pipeline, stage)
+		pipeline.Stages = append(pipeline.Stages, stage)
 		if i > 0 {
-			stage.SetPrev(pipeline[i-1])
-			pipeline[i-1].SetNext(stage)
+			stage.SetPrev(pipeline.Stages[i-1])
+			pipeline.Stages[i-1].SetNext(stage)
+		}
+		hooks := stageHooks(stage)
+		switch {
+		case indexOf(hooks, "EX") >= 0:
+			path = ForwardEXtoEX
+		case indexOf(hooks, "MEM3") >= 0:
+			path = ForwardMEM3toID
+		case path == ForwardEXtoEX:
+			path = ForwardMEMtoEX
+		}
+		if path != 0 && i < len(stages)-1 {
+			pipeline.Latches = append(pipeline.Latches, &Latch{
+				Name:  fmt.Sprintf("%s/%s", stage, stages[i+1]),
+				Path:  path,
+				stage: stage,
+			})
 		}
-
 	}
-	if len(pipeline) == 0 {
-		return nil, errors.New("Must have at least one stage")
+	if len(pipeline.Stages) == 0 {
+		return pipeline, errors.New("Must have at least one stage")
 	}
 	return pipeline, nil
 }
 
-func (p Pipeline) cpu() *CPU { return p[0].CPU() }
+func (p Pipeline) cpu() *CPU { return p.Stages[0].CPU() }
 
 func (p Pipeline) Reverse() []PipelineStage {
-	result := make([]PipelineStage, len(p))
-	for i := 0; i < len(p); i++ {
-		result[i] = p[len(p)-i-1]
+	result := make([]PipelineStage, len(p.Stages))
+	for i := 0; i < len(p.Stages); i++ {
+		result[i] = p.Stages[len(p.Stages)-i-1]
 	}
 	return result
 }
 
+// outputter is implemented by stages whose output is not simply the
+// instruction in their slot, such as EX
+type outputter interface {
+	output() []*ExecutedInstruction
+}
+
+// latch updates the latch at the output of a stage after it has stepped
+func (p Pipeline) latch(stage PipelineStage) {
+	for _, l := range p.Latches {
+		if l.stage != stage {
+			continue
+		}
+		l.Instructions = l.Instructions[:0]
+		if o, ok := stage.(outputter); ok {
+			l.Instructions = append(l.Instructions, o.output()...)
+		} else {
+			l.Instructions = append(l.Instructions, stage.Slots()...)
+		}
+	}
+}
+
+// producer returns the youngest instruction past ID that writes r, and the
+// forwarding path its value would be read over: the path of the latch
+// behind its stage, or the register file once it is in writeback.
+func (p Pipeline) producer(r Register) (producer *ExecutedInstruction, path ForwardingPath) {
+	decoded := false
+	for n, stage := range p.Stages {
+		if decoded == false {
+			decoded = indexOf(stageHooks(stage), "ID") >= 0
+			continue
+		}
+		for _, i := range stage.Active() {
+			if producer != nil && i.Index < producer.Index {
+				continue
+			}
+			for _, w := range i.Writes() {
+				if w == r {
+					producer, path = i, p.pathFrom(stage)
+					if n == len(p.Stages)-1 {
+						path = ForwardWBtoID
+					}
+				}
+			}
+		}
+	}
+	return producer, path
+}
+
+// stageIndex returns the position of the named stage, or -1
+func (p Pipeline) stageIndex(name string) int {
+	for n, stage := range p.Stages {
+		if stage.String() == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// pathOf returns the forwarding path the result of an instruction in flight
+// would be read over
+func (p Pipeline) pathOf(i *ExecutedInstruction) ForwardingPath {
+	for n, stage := range p.Stages {
+		if indexOfInstruction(stage.Active(), i) < 0 {
+			continue
+		}
+		if n == len(p.Stages)-1 {
+			return ForwardWBtoID
+		}
+		return p.pathFrom(stage)
+	}
+	return 0
+}
+
+func (p Pipeline) pathFrom(stage PipelineStage) ForwardingPath {
+	for _, l := range p.Latches {
+		if l.stage == stage {
+			return l.Path
+		}
+	}
+	return 0
+}
+
 // Execute a cycle in the pipeline
 func (p Pipeline) Execute() error {
 
+	p.Hazards.Detected = nil
+
 	// run pipeline pipeline stages back to front to execute older instructions first
 	//for _, stage := range p.Reverse() {
-	for i := len(p) - 1; i >= 0; i-- {
-		stage := p[i]
+	for i := len(p.Stages) - 1; i >= 0; i-- {
+		stage := p.Stages[i]
 
 		stage.Unstall()
-		switch err := stage.Step(); {
-		case err == RAWHazard:
-			//fmt.Println("RAWHazard in", stage, stage.GetInstruction(), "stalling")
-			stage.Stall()
-			return nil
-		case err == FlushPipeline:
-			// flush and finish cycle
-			p.FlushBefore(stage)
-			i = 0
-			p.RecordTiming(stage)
-		case err == BranchResolving:
-			p.StallBefore(stage)
-			p.RecordTiming(stage)
-		case err == nil:
-			// entered stage successfully, record timing if an instruction is present
-			p.RecordTiming(stage)
-		case err != nil:
-			return errors.New(fmt.Sprintf("Error while executing %s of %s: %s", stage, stage.GetInstruction(), err))
+		// the slots of a stage oldest first, empty slots of fetch stages
+		// fetch. EX dispatches all of its slots in one step.
+		slots := stage.Width()
+		if _, ok := stage.(transferrer); ok {
+			slots = 1
+		}
+		for n := 0; n < slots; n++ {
+			stage.Select(n)
+			err := stage.Step()
+			p.latch(stage)
+			var hazard *Hazard
+			switch {
+			case errors.As(err, &hazard), err == RAWHazard, err == WAWHazard, err == Stall:
+				//fmt.Println("RAWHazard in", stage, stage.GetInstruction(), "stalling")
+				p.Hazards.record(stage, err)
+				stage.Stall()
+				p.Hazards.attribute()
+				return nil
+			case err == FlushPipeline:
+				// flush and finish cycle
+				p.Hazards.record(stage, err)
+				p.FlushBefore(stage)
+				i = 0
+				p.RecordTiming(stage)
+				// the delay slots after the branch still step, nothing is
+				// fetched
+				slots = len(stage.Slots())
+			case err == BranchResolving:
+				p.Hazards.record(stage, err)
+				p.StallBefore(stage)
+				p.RecordTiming(stage)
+			case err == nil:
+				// entered stage successfully, record timing if an instruction is present
+				p.RecordTiming(stage)
+			case err != nil:
+				return executionError(err, stage.GetInstruction(), stage.String(), p.cpu().Cycle)
+			}
 		}
-
 	}
+	p.Hazards.attribute()
 	return nil
 }
 
+// hooker is implemented by stages that do the work of several of the nine
+// stages, hooks names the instruction hooks the stage runs in order
+type hooker interface {
+	hooks() []string
+}
+
+// stageHooks returns the names of the instruction hooks a stage runs
+func stageHooks(stage PipelineStage) []string {
+	if h, ok := stage.(hooker); ok {
+		return h.hooks()
+	}
+	return []string{stage.String()}
+}
+
+// runHooks runs the hooks of a stage standing in for several stages. A
+// hazard or error ends the stage at once, otherwise a flush outweighs a
+// resolving branch.
+func runHooks(hooks ...func() error) error {
+	var result error
+	for _, hook := range hooks {
+		switch err := hook(); err {
+		case nil:
+		case BranchResolving:
+			if result == nil {
+				result = err
+			}
+		case FlushPipeline:
+			result = err
+		default:
+			return err
+		}
+	}
+	return result
+}
+
+// transferrer is implemented by stages that hold instructions outside of
+// their single slot, such as EX with its functional units, and so move
+// instructions to the next stage themselves
+type transferrer interface {
+	transfer()
+}
+
 func (p Pipeline) TransferInstruction(fromStage PipelineStage) error {
-	if fromStage.Stalled() {
+	if t, ok := fromStage.(transferrer); ok {
+		t.transfer()
+		return nil
+	}
+	if fromStage.Stalled() && len(fromStage.Leaving()) == 0 {
 		//fmt.Println("TransferInstruction fromstage stalled", fromStage)
 		return nil
 	}
-	instruction := fromStage.GetInstruction()
+	// a stalled stage keeps the stalled instruction and those after it
+	leaving := fromStage.Leaving()
+	staying := append([]*ExecutedInstruction{}, fromStage.Slots()[len(leaving):]...)
 	toStage := fromStage.Next()
 	if toStage != nil {
-		if instruction != nil {
-			//fmt.Println("TransferInstruction ", fromStage, toStage, instruction)
-		}
-		toStage.SetInstruction(instruction)
-		if instruction != nil {
-			//fmt.Println("TransferInstruction ::: ", toStage.GetInstruction(), &toStage)
-		}
+		toStage.SetSlots(leaving)
 	}
-	if instruction != nil {
+	for _, instruction := range leaving {
 		instruction.Stage = toStage
 	}
-	fromStage.SetInstruction(nil)
+	fromStage.SetSlots(staying)
 	return nil
 }
 
 func (p Pipeline) RecordTiming(stage PipelineStage) {
 	if i := stage.GetInstruction(); i != nil {
-		i.Stages[stage.String()] = p.cpu().Cycle
-		i.Cycles[p.cpu().Cycle] = stage.String()
+		recordStage(i, stage.String(), p.cpu().Cycle)
 	}
 }
 
 func (p Pipeline) TransferInstructions() error {
-	for i := len(p) - 1; i >= 0; i-- {
-		stage := p[i]
+	for i := len(p.Stages) - 1; i >= 0; i-- {
+		stage := p.Stages[i]
 		err := p.TransferInstruction(stage)
 		if err == PipelineStall {
 			fmt.Println("Encountered stall, stopping instruction transfer.")
@@ -143,7 +376,7 @@ func (p Pipeline) TransferInstructions() error {
 }
 func (p Pipeline) GetNextStage(s PipelineStage) PipelineStage {
 	index := -1
-	for i, stage := range p {
+	for i, stage := range p.Stages {
 		if index != -1 {
 			return stage
 		}
@@ -151,27 +384,27 @@ func (p Pipeline) GetNextStage(s PipelineStage) PipelineStage {
 			index = i
 		}
 	}
-	return p[0]
+	return p.Stages[0]
 }
 
 func (p Pipeline) GetPreviousStage(s PipelineStage) PipelineStage {
 	index := -1
-	for i, stage := range p {
+	for i, stage := range p.Stages {
 		fmt.Println("eq?", stage, s)
 		if stage == s {
 			index = i
 		}
 	}
 	if index > 0 {
-		return p[index]
+		return p.Stages[index]
 	}
 	return nil
 }
 
 func (p Pipeline) Empty() bool {
 	allEmpty := true
-	for _, stage := range p {
-		if stage.GetInstruction() != nil {
+	for _, stage := range p.Stages {
+		if len(stage.Active()) > 0 {
 			allEmpty = false
 		}
 	}
@@ -186,24 +419,47 @@ func (p Pipeline) StallBefore(stage PipelineStage) {
 	}
 }
 
+// FlushBefore flushes the instructions fetched after the branch in stage,
+// except for those in its delay slots: those after it in the stage's slots
+// and those in the stages before it
 func (p Pipeline) FlushBefore(stage PipelineStage) {
-	stage = stage.Prev()
+	branch, from := stage.GetInstruction(), stage
+	flushed := make([]*ExecutedInstruction, 0)
 	for stage != nil {
 		//fmt.Println("flushing", stage, stage.GetInstruction())
-		i := stage.GetInstruction()
-		if i != nil {
+		kept := make([]*ExecutedInstruction, 0)
+		for _, i := range stage.Slots() {
+			if branch != nil && i.Index <= branch.Index+p.cpu().DelaySlots {
+				kept = append(kept, i)
+				continue
+			}
 			i.Flush()
+			flushed = append(flushed, i)
 			i.CycleFlush = p.cpu().Cycle
 			i.CycleFinish = p.cpu().Cycle
 		}
-		stage.SetInstruction(nil)
+		stage.SetSlots(kept)
 		//fmt.Println("flushed", stage, stage.GetInstruction())
 		stage = stage.Prev()
 	}
+	if p.cpu().Renaming != nil {
+		p.cpu().Renaming.squash(flushed)
+	}
+	// the branch is still the instruction stepped
+	from.Select(indexOfInstruction(from.Slots(), branch))
+}
+
+func indexOfInstruction(list []*ExecutedInstruction, i *ExecutedInstruction) int {
+	for n, v := range list {
+		if v == i {
+			return n
+		}
+	}
+	return -1
 }
 
 func (p Pipeline) xFlush(currentCycle int) {
-	for _, stage := range p {
+	for _, stage := range p.Stages {
 		i := stage.GetInstruction()
 		if i != nil {
 			i.CycleFlush = currentCycle
@@ -218,29 +474,41 @@ func (p Pipeline) StageNames() (result []string) {
 		return result
 	}
 	result = make([]string, 0)
-	for _, stage := range p {
+	for _, stage := range p.Stages {
 		result = append(result, stage.String())
 	}
 	stageStringCache[&p] = result
 	return result
 }
 
+// fetchStages returns the names of the stages before decode, and the name of
+// the decode stage
+func (p Pipeline) fetchStages() (fetch []string, decode string) {
+	for _, stage := range p.Stages {
+		if indexOf(stageHooks(stage), "ID") >= 0 {
+			return fetch, stage.String()
+		}
+		fetch = append(fetch, stage.String())
+	}
+	return fetch, ""
+}
+
 func (p Pipeline) ActiveInstructions() []*ExecutedInstruction {
 	result := make([]*ExecutedInstruction, 0)
 
-	for _, stage := range p {
-		iip := stage.GetInstruction()
-		if iip != nil {
-			result = append(result, iip)
-		}
+	for _, stage := range p.Stages {
+		result = append(result, stage.Active()...)
 	}
 
 	return result
 }
 
 type stage struct {
-	instruction *ExecutedInstruction
+	instruction *ExecutedInstruction   // the selected slot
+	slots       []*ExecutedInstruction // oldest first
+	width       int
 	stalled     bool
+	held        int // the first slot held by a stall
 	cpu         *CPU
 	next        PipelineStage
 	prev        PipelineStage
@@ -262,8 +530,14 @@ func (s stage) String() string {
 	return "unknown"
 }
 
+// Stall holds the selected slot and those after it in the stage, the slots
+// before it move on
 func (s *stage) Stall() {
 	s.stalled = true
+	s.held = 0
+	if n := indexOfInstruction(s.slots, s.instruction); n > 0 {
+		s.held = n
+	}
 }
 
 func (s *stage) Unstall() {
@@ -290,14 +564,70 @@ func (s *stage) SetNext(p PipelineStage) {
 	s.next = p
 }
 
+// GetInstruction returns the instruction in the selected slot
 func (s *stage) GetInstruction() *ExecutedInstruction {
 	return s.instruction
 }
 
+// SetInstruction puts an instruction in the stage's only slot, or empties
+// it if nil
 func (s *stage) SetInstruction(instruction *ExecutedInstruction) {
+	s.slots = s.slots[:0]
+	if instruction != nil {
+		s.slots = append(s.slots, instruction)
+	}
 	s.instruction = instruction
 }
 
+// Width returns the number of slots, the instructions the stage holds at
+// most
+func (s *stage) Width() int {
+	if s.width < 1 {
+		return 1
+	}
+	return s.width
+}
+
+func (s *stage) SetWidth(n int) {
+	s.width = n
+}
+
+// Select makes slot the slot Step works on, an empty slot if past the
+// instructions held
+func (s *stage) Select(slot int) {
+	s.instruction = nil
+	if slot < len(s.slots) {
+		s.instruction = s.slots[slot]
+	}
+}
+
+// Slots returns the instructions in the stage's slots, oldest first
+func (s *stage) Slots() []*ExecutedInstruction {
+	return s.slots
+}
+
+func (s *stage) SetSlots(instructions []*ExecutedInstruction) {
+	s.slots = append(s.slots[:0], instructions...)
+	s.Select(0)
+}
+
+// Leaving returns the instructions moving on to the next stage: none while
+// it is stalled, those before the held slots while the stage is
+func (s *stage) Leaving() []*ExecutedInstruction {
+	switch {
+	case s.next != nil && s.next.Stalled():
+		return nil
+	case s.stalled:
+		return s.slots[:s.held]
+	}
+	return s.slots
+}
+
+// Active returns the instructions held by the stage
+func (s *stage) Active() []*ExecutedInstruction {
+	return s.slots
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // IF1
 /////////////////////////////////////////////////////////////////////////////
@@ -315,27 +645,49 @@ func (s *IF1) Step() error {
 	}
 
 	// otherwise fetch a new instruction if possible
+	if s.fetch(s) {
+		return s.instruction.IF1()
+	}
+	return nil
+}
 
-	if s.cpu.InstructionCacheEmpty() == false {
+// fetch issues the instruction at the instruction pointer into the stage,
+// reporting whether there was one
+func (s *stage) fetch(into PipelineStage) bool {
+	if s.cpu.InstructionCacheEmpty() && s.cpu.delaySlots > 0 {
+		// delay slots past the end of the code are empty
+		s.cpu.delaySlots = 0
+		s.cpu.InstructionPointer = s.cpu.delayedJump
+	}
+	if s.cpu.InstructionCacheEmpty() {
+		return false
+	}
 
-		s.instruction = &ExecutedInstruction{
-			Instruction: s.cpu.InstructionCache[s.cpu.InstructionPointer],
-			Stage:       s,
-			Stages:      make(map[string]int, 0),
-			Cycles:      make(map[int]string, 0),
-			CycleStart:  s.cpu.Cycle, // Start
-			CycleFinish: -1,
-			CycleFlush:  -1,
-		}
+	s.instruction = &ExecutedInstruction{
+		Instruction: copyInstruction(s.cpu.InstructionCache[s.cpu.InstructionPointer]),
+		Index:       len(s.cpu.Instructions),
+		Stage:       into,
+		Stages:      make(map[string]int, 0),
+		Cycles:      make(map[int]string, 0),
+		Stalls:      make(map[int]*Hazard),
+		CycleStart:  s.cpu.Cycle, // Start
+		CycleFinish: -1,
+		CycleFlush:  -1,
+	}
 
-		// record instuction in cpu's list of execut(ed|ing) instructions
-		s.cpu.Instructions = append(s.cpu.Instructions, s.instruction)
+	// record instuction in cpu's list of execut(ed|ing) instructions
+	s.cpu.Instructions = append(s.cpu.Instructions, s.instruction)
+	s.slots = append(s.slots, s.instruction)
 
-		//fmt.Println("Issue:", s.instruction)
-		s.cpu.InstructionPointer += 1
-		return s.instruction.IF1()
+	//fmt.Println("Issue:", s.instruction)
+	s.cpu.InstructionPointer += 1
+	if s.cpu.delaySlots > 0 {
+		s.cpu.delaySlots -= 1
+		if s.cpu.delaySlots == 0 {
+			s.cpu.InstructionPointer = s.cpu.delayedJump
+		}
 	}
-	return nil
+	return true
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -368,6 +720,29 @@ func (s *IF3) Step() error {
 	return s.instruction.IF3()
 }
 
+/////////////////////////////////////////////////////////////////////////////
+// IF
+/////////////////////////////////////////////////////////////////////////////
+
+// IF is the single fetch stage of the classic five stage pipeline, doing the
+// work of IF1, IF2 and IF3 in one cycle
+type IF struct{ stage }
+
+func (s IF) String() string { return "IF" }
+
+func (s *IF) hooks() []string { return []string{"IF1", "IF2", "IF3"} }
+
+func (s *IF) Step() error {
+	if s.instruction != nil {
+		return nil
+	}
+	if s.fetch(s) == false {
+		return nil
+	}
+	i := s.instruction
+	return runHooks(i.IF1, i.IF2, i.IF3)
+}
+
 /////////////////////////////////////////////////////////////////////////////
 // ID
 /////////////////////////////////////////////////////////////////////////////
@@ -381,23 +756,134 @@ func (s *ID) Step() error {
 	if s.instruction == nil {
 		return nil
 	}
-	err := s.instruction.ID()
-	return err
+	i := s.instruction
+	operands, err := s.cpu.Pipeline.Hazards.Decode(i)
+	if err != nil {
+		return err
+	}
+	// the hooks read the operands decode has read
+	s.cpu.operands = operands
+	defer func() { s.cpu.operands = nil }()
+	return runHooks(i.ID, s.reserve, i.Resolve)
+}
+
+func (s *ID) hooks() []string { return []string{"ID", "Resolve"} }
+
+// reserve has the hazard unit reserve the destinations of the instruction
+// once it has read its operands
+func (s *stage) reserve() error {
+	s.cpu.Pipeline.Hazards.Reserve(s.instruction)
+	return nil
 }
 
 /////////////////////////////////////////////////////////////////////////////
 // EX
 /////////////////////////////////////////////////////////////////////////////
 
-type EX struct{ stage }
+// EX dispatches instructions to the CPU's functional units. The slots hold
+// instructions waiting for their units, out holds the finished instructions
+// moving on to the next stage.
+type EX struct {
+	stage
+	out  []*ExecutedInstruction
+	name string // shown instead of EX, set by machine descriptions
+}
 
-func (s EX) String() string { return "EX" }
+func (s EX) String() string {
+	if s.name != "" {
+		return s.name
+	}
+	return "EX"
+}
+
+func (s *EX) hooks() []string { return []string{"EX"} }
 
 func (s *EX) Step() error {
-	if s.instruction == nil {
-		return nil
+	completed := make([]*ExecutedInstruction, 0)
+	for _, u := range s.cpu.Units {
+		completed = append(completed, u.advance(s.cpu.Cycle)...)
+	}
+
+	// a busy unit is a structural hazard, the instruction and those after
+	// it wait in EX
+	var hazard error
+	for len(s.slots) > 0 {
+		i := s.slots[0]
+		u, err := s.cpu.unitFor(i)
+		if err != nil {
+			return err
+		}
+		if hazard = s.cpu.Pipeline.Hazards.Dispatch(i, u); hazard != nil {
+			break
+		}
+		if u.dispatch(i, s.cpu.Cycle) {
+			completed = append(completed, i)
+		}
+		s.slots = s.slots[1:]
+	}
+	s.Select(0)
+
+	// results are computed as instructions reach the end of their unit
+	for _, i := range completed {
+		if err := i.EX(); err != nil {
+			return err
+		}
+	}
+
+	// the oldest finished instructions leave for the next stage
+	if len(s.out) == 0 {
+		for len(s.out) < s.Width() {
+			var oldest *ExecutedInstruction
+			for _, u := range s.cpu.Units {
+				if i := u.finished(); i != nil && (oldest == nil || i.Index < oldest.Index) {
+					oldest = i
+				}
+			}
+			if oldest == nil {
+				break
+			}
+			for _, u := range s.cpu.Units {
+				u.remove(oldest)
+			}
+			s.out = append(s.out, oldest)
+		}
+	}
+	return hazard
+}
+
+func (s *EX) transfer() {
+	if len(s.out) == 0 || (s.next != nil && s.next.Stalled()) {
+		return
+	}
+	if s.next != nil {
+		s.next.SetSlots(s.out)
+	}
+	for _, i := range s.out {
+		i.Stage = s.next
+	}
+	s.out = nil
+}
+
+// output is the instructions leaving EX and those that have finished but
+// wait for them in their functional units
+func (s *EX) output() []*ExecutedInstruction {
+	result := make([]*ExecutedInstruction, 0)
+	result = append(result, s.out...)
+	for _, u := range s.cpu.Units {
+		if i := u.finished(); i != nil {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func (s *EX) Active() []*ExecutedInstruction {
+	result := s.stage.Active()
+	for _, u := range s.cpu.Units {
+		result = append(result, u.Instructions()...)
 	}
-	return s.instruction.EX()
+	result = append(result, s.out...)
+	return result
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -446,7 +932,27 @@ func (s *MEM3) Step() error {
 }
 
 /////////////////////////////////////////////////////////////////////////////
-//
+// MEM
+/////////////////////////////////////////////////////////////////////////////
+
+// MEM is the single memory stage of the classic five stage pipeline, doing
+// the work of MEM1, MEM2 and MEM3 in one cycle
+type MEM struct{ stage }
+
+func (s MEM) String() string { return "MEM" }
+
+func (s *MEM) hooks() []string { return []string{"MEM1", "MEM2", "MEM3"} }
+
+func (s *MEM) Step() error {
+	if s.instruction == nil {
+		return nil
+	}
+	i := s.instruction
+	return runHooks(i.MEM1, i.MEM2, i.MEM3)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// WB
 /////////////////////////////////////////////////////////////////////////////
 
 type WB struct{ stage }
@@ -457,11 +963,21 @@ func (s *WB) Step() error {
 	if s.instruction == nil {
 		return nil
 	}
+	s.writeBack()
+	return nil
+}
+
+// writeBack runs WB, finishing the instruction
+func (s *stage) writeBack() {
+	s.cpu.writing = s.instruction
 	err := s.instruction.WB()
+	s.cpu.writing = nil
 	if err == nil {
 		s.instruction.CycleFinish = s.cpu.Cycle
+		if s.cpu.Renaming != nil {
+			s.cpu.Renaming.retire(s.instruction)
+		}
 	}
-	return nil
 }
 
 // internal caching for stage list generation
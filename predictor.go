@@ -0,0 +1,147 @@
+package mips
+
+// BranchPredictor predicts branches from their address, the index of the
+// instruction in the code. It is consulted in IF2 under
+// BranchPolicyPredictDynamic and trained with the outcome when the branch
+// resolves.
+type BranchPredictor interface {
+	Predict(pc int) (taken bool)
+	Update(pc int, taken bool)
+}
+
+// counters is a table of saturating counters, predicting taken in the upper
+// half of their range
+type counters struct {
+	values []int
+	max    int
+}
+
+func newCounters(entries, bits int) counters {
+	if entries < 1 {
+		entries = 1
+	}
+	c := counters{values: make([]int, entries), max: 1<<uint(bits) - 1}
+	// weakly not taken
+	for n := range c.values {
+		c.values[n] = c.max / 2
+	}
+	return c
+}
+
+func (c counters) index(n int) int {
+	n %= len(c.values)
+	if n < 0 {
+		n += len(c.values)
+	}
+	return n
+}
+
+func (c counters) taken(n int) bool {
+	return c.values[c.index(n)] > c.max/2
+}
+
+func (c counters) update(n int, taken bool) {
+	n = c.index(n)
+	switch {
+	case taken && c.values[n] < c.max:
+		c.values[n]++
+	case taken == false && c.values[n] > 0:
+		c.values[n]--
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Bimodal
+/////////////////////////////////////////////////////////////////////////////
+
+// BimodalPredictor indexes a table of counters with the branch address
+type BimodalPredictor struct {
+	table counters
+}
+
+// NewBimodalPredictor returns a predictor with a table of entries counters
+// of bits bits each
+func NewBimodalPredictor(entries, bits int) *BimodalPredictor {
+	return &BimodalPredictor{table: newCounters(entries, bits)}
+}
+
+// NewOneBitPredictor remembers the last outcome of each branch
+func NewOneBitPredictor(entries int) *BimodalPredictor {
+	return NewBimodalPredictor(entries, 1)
+}
+
+// NewTwoBitPredictor changes its prediction after two mispredictions
+func NewTwoBitPredictor(entries int) *BimodalPredictor {
+	return NewBimodalPredictor(entries, 2)
+}
+
+func (p *BimodalPredictor) Predict(pc int) bool {
+	return p.table.taken(pc)
+}
+
+func (p *BimodalPredictor) Update(pc int, taken bool) {
+	p.table.update(pc, taken)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// gshare
+/////////////////////////////////////////////////////////////////////////////
+
+// GSharePredictor indexes a table of two bit counters with the branch
+// address xor the outcomes of the last branches
+type GSharePredictor struct {
+	table   counters
+	history int
+	mask    int
+}
+
+// NewGSharePredictor returns a predictor keeping historyBits outcomes and
+// 2^historyBits counters
+func NewGSharePredictor(historyBits int) *GSharePredictor {
+	mask := 1<<uint(historyBits) - 1
+	return &GSharePredictor{table: newCounters(mask+1, 2), mask: mask}
+}
+
+func (p *GSharePredictor) Predict(pc int) bool {
+	return p.table.taken((pc ^ p.history) & p.mask)
+}
+
+func (p *GSharePredictor) Update(pc int, taken bool) {
+	p.table.update((pc^p.history)&p.mask, taken)
+	p.history = (p.history << 1) & p.mask
+	if taken {
+		p.history |= 1
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Tournament
+/////////////////////////////////////////////////////////////////////////////
+
+// TournamentPredictor chooses per branch between two predictors, e.g. a
+// bimodal and a gshare one, by which has been right more often
+type TournamentPredictor struct {
+	chooser       counters // taken means use second
+	first, second BranchPredictor
+}
+
+// NewTournamentPredictor returns a predictor with entries two bit choosers
+func NewTournamentPredictor(entries int, first, second BranchPredictor) *TournamentPredictor {
+	return &TournamentPredictor{chooser: newCounters(entries, 2), first: first, second: second}
+}
+
+func (p *TournamentPredictor) Predict(pc int) bool {
+	if p.chooser.taken(pc) {
+		return p.second.Predict(pc)
+	}
+	return p.first.Predict(pc)
+}
+
+func (p *TournamentPredictor) Update(pc int, taken bool) {
+	first, second := p.first.Predict(pc) == taken, p.second.Predict(pc) == taken
+	if first != second {
+		p.chooser.update(pc, second)
+	}
+	p.first.Update(pc, taken)
+	p.second.Update(pc, taken)
+}
@@ -0,0 +1,58 @@
+package mips
+
+// What a full return address stack does with another call
+type RASOverflow int
+
+const (
+	RASOverwrite RASOverflow = iota // drop the oldest return address
+	RASDiscard                      // drop the new return address
+)
+
+// ReturnAddressStack predicts the targets of returns (JR R31). Calls push
+// their return address when fetched, returns pop it in IF2. Hits and misses
+// are counted when the return resolves, popping an empty stack is a miss.
+type ReturnAddressStack struct {
+	Depth     int
+	Overflow  RASOverflow
+	Hits      int
+	Misses    int
+	Overflows int
+	addresses []Word // top last
+}
+
+// NewReturnAddressStack returns a stack of depth return addresses
+func NewReturnAddressStack(depth int, overflow RASOverflow) *ReturnAddressStack {
+	return &ReturnAddressStack{Depth: depth, Overflow: overflow}
+}
+
+func (r *ReturnAddressStack) Push(address Word) {
+	if len(r.addresses) == r.Depth {
+		r.Overflows++
+		if r.Overflow == RASDiscard {
+			return
+		}
+		r.addresses = r.addresses[1:]
+	}
+	r.addresses = append(r.addresses, address)
+}
+
+// checkpoint returns a copy of the addresses on the stack
+func (r *ReturnAddressStack) checkpoint() []Word {
+	return append([]Word{}, r.addresses...)
+}
+
+// restore puts back the addresses of a checkpoint, undoing the calls and
+// returns fetched since
+func (r *ReturnAddressStack) restore(addresses []Word) {
+	r.addresses = append(r.addresses[:0], addresses...)
+}
+
+func (r *ReturnAddressStack) Pop() (Word, bool) {
+	if len(r.addresses) == 0 {
+		r.Misses++
+		return 0, false
+	}
+	address := r.addresses[len(r.addresses)-1]
+	r.addresses = r.addresses[:len(r.addresses)-1]
+	return address, true
+}
@@ -47,6 +47,41 @@ const (
 	R29
 	R30
 	R31
+	HI // multiply and divide results
+	LO
+	F0 // floating point registers, holding IEEE 754 doubles
+	F1
+	F2
+	F3
+	F4
+	F5
+	F6
+	F7
+	F8
+	F9
+	F10
+	F11
+	F12
+	F13
+	F14
+	F15
+	F16
+	F17
+	F18
+	F19
+	F20
+	F21
+	F22
+	F23
+	F24
+	F25
+	F26
+	F27
+	F28
+	F29
+	F30
+	F31
+	FCC // floating point condition flag, set by C.LT.D
 	numRegisters
 )
 
@@ -65,7 +100,12 @@ func NewRegisters() *Registers {
 func (r Registers) String() string {
 	result := ""
 	for i := 0; i < numRegisters; i++ {
-		if r.values[i] != 0 {
+		if r.values[i] == 0 {
+			continue
+		}
+		if Register(i).Float() {
+			result += fmt.Sprintf("%s = %g\n", Register(i), r.values[i].Float())
+		} else {
 			result += fmt.Sprintf("%s = %d\n", Register(i), r.values[i])
 		}
 	}
@@ -112,6 +152,21 @@ func (r *Registers) Get(register Register) Word {
 	return r.values[register]
 }
 
+// Float reports whether r is one of the floating point registers F0-F31
+func (r Register) Float() bool {
+	return r >= F0 && r <= F31
+}
+
 func (r Register) String() string {
+	switch {
+	case r == HI:
+		return "HI"
+	case r == LO:
+		return "LO"
+	case r == FCC:
+		return "FCC"
+	case r.Float():
+		return fmt.Sprintf("F%d", uint64(r-F0))
+	}
 	return fmt.Sprintf("R%d", uint64(r))
 }
@@ -0,0 +1,224 @@
+package mips
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// RenameMap maps the architectural registers R0-R31 to physical registers
+type RenameMap [32]int
+
+// RenameTable renames the general purpose registers R1-R31 onto a pool of
+// physical registers P0..P(Size-1), so that instructions writing the same
+// register, or one that an older instruction is still to read, need not wait
+// for each other. ID maps the registers an instruction reads and gives each
+// register it writes a physical register from the free list. The register it
+// replaces is freed once the instruction has written back and the
+// replaced register has been written. R0 stays mapped to P0, the floating
+// point registers, HI, LO and FCC are not renamed.
+//
+// The CPU's Registers remain the architectural view, holding for each
+// register the value of the youngest instruction to have written it back.
+type RenameTable struct {
+	Size     int
+	Map      RenameMap   // the current mapping, including instructions yet to write back
+	History  []RenameMap // the map at the end of each cycle, from cycle 1
+	Free     []int       // free physical registers at the end of each cycle, from cycle 1
+	free     []int       // allocated oldest first
+	values   []Word
+	ready    []bool                 // written, or holding an initial value
+	writers  []*ExecutedInstruction // the instructions to write the registers not ready
+	released []bool                 // replaced, to be freed once written
+	latest   [32]int                // index of the youngest instruction to have written back each register
+	arch     *Registers
+}
+
+// renaming is the physical register given to a destination, and the one it
+// replaced
+type renaming struct {
+	register Register
+	physical int
+	previous int
+}
+
+// NewRenameTable returns a table of size physical registers, the first 32
+// holding R0-R31
+func NewRenameTable(size int, arch *Registers) *RenameTable {
+	t := &RenameTable{
+		Size:     size,
+		values:   make([]Word, size),
+		ready:    make([]bool, size),
+		writers:  make([]*ExecutedInstruction, size),
+		released: make([]bool, size),
+		arch:     arch,
+	}
+	for r := R0; r <= R31; r++ {
+		t.Map[r] = int(r)
+		t.ready[r] = true
+		t.latest[r] = -1
+	}
+	for p := len(t.Map); p < size; p++ {
+		t.free = append(t.free, p)
+	}
+	return t
+}
+
+// renames reports whether r is renamed, a nil table renames nothing
+func (t *RenameTable) renames(r Register) bool {
+	return t != nil && r > R0 && r <= R31
+}
+
+// Available returns the number of free physical registers
+func (t *RenameTable) Available() int {
+	return len(t.free)
+}
+
+// load copies the initial values of R1-R31 into their physical registers
+func (t *RenameTable) load() {
+	for r := R1; r <= R31; r++ {
+		t.values[t.Map[r]] = t.arch.Get(Register(r))
+	}
+}
+
+// destinations returns the registers written by i that are renamed
+func (t *RenameTable) destinations(i *ExecutedInstruction) []Register {
+	result := make([]Register, 0)
+	for _, r := range i.Writes() {
+		if t.renames(r) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// read returns the value of the physical register r is mapped to, or the
+// instruction still to write it
+func (t *RenameTable) read(r Register) (Word, *ExecutedInstruction) {
+	p := t.Map[r]
+	if t.ready[p] {
+		return t.values[p], nil
+	}
+	return 0, t.writers[p]
+}
+
+// rename gives each renamed destination of i a free physical register. The
+// hazard unit has checked that there are enough.
+func (t *RenameTable) rename(i *ExecutedInstruction) {
+	for _, r := range t.destinations(i) {
+		p := t.free[0]
+		t.free = t.free[1:]
+		t.ready[p], t.writers[p], t.released[p] = false, i, false
+		i.renamed = append(i.renamed, renaming{register: r, physical: p, previous: t.Map[r]})
+		t.Map[r] = p
+	}
+}
+
+// write writes a result of i in writeback to its physical register, and to
+// the architectural view unless a younger instruction has written it already
+func (t *RenameTable) write(i *ExecutedInstruction, r Register, value Word) error {
+	for _, n := range i.renamed {
+		if n.register == r {
+			t.fill(n.physical, value)
+		}
+	}
+	if i.Index < t.latest[r] {
+		return nil
+	}
+	t.latest[r] = i.Index
+	return t.arch.Set(r, value)
+}
+
+// fill writes a physical register, freeing it if it has been replaced
+// already
+func (t *RenameTable) fill(p int, value Word) {
+	t.values[p], t.ready[p], t.writers[p] = value, true, nil
+	if t.released[p] {
+		t.release(p)
+	}
+}
+
+// retire frees the registers replaced by i once it has written back. A
+// destination i did not write keeps the value it replaced.
+func (t *RenameTable) retire(i *ExecutedInstruction) {
+	for _, n := range i.renamed {
+		if t.ready[n.physical] == false && t.writers[n.physical] == i {
+			t.fill(n.physical, t.values[n.previous])
+		}
+		t.release(n.previous)
+	}
+}
+
+// release frees a replaced physical register, or marks it to be freed when
+// written
+func (t *RenameTable) release(p int) {
+	t.released[p] = true
+	if t.ready[p] {
+		t.released[p] = false
+		t.free = append(t.free, p)
+	}
+}
+
+// squash undoes the renaming of flushed instructions, youngest first
+func (t *RenameTable) squash(flushed []*ExecutedInstruction) {
+	sort.Slice(flushed, func(a, b int) bool { return flushed[a].Index > flushed[b].Index })
+	for _, i := range flushed {
+		for n := len(i.renamed) - 1; n >= 0; n-- {
+			r := i.renamed[n]
+			t.Map[r.register] = r.previous
+			t.writers[r.physical] = nil
+			t.free = append(t.free, r.physical)
+		}
+		i.renamed = nil
+	}
+}
+
+// record notes the map at the end of a cycle
+func (t *RenameTable) record() {
+	t.History = append(t.History, t.Map)
+	t.Free = append(t.Free, len(t.free))
+}
+
+// String renders the registers not mapped to their initial physical
+// register, e.g. "RAT[R1=P33 R4=P35 free 30]"
+func (t *RenameTable) String() string {
+	result := new(bytes.Buffer)
+	result.WriteString("RAT[")
+	for r := R1; r <= R31; r++ {
+		if t.Map[r] != int(r) {
+			fmt.Fprintf(result, "%s=P%d ", Register(r), t.Map[r])
+		}
+	}
+	fmt.Fprintf(result, "free %d]", len(t.free))
+	return string(result.Bytes())
+}
+
+// RenderMaps renders the map table at the end of each cycle, with a column
+// for each register renamed during the run and the free registers left
+func (t *RenameTable) RenderMaps() string {
+	registers := make([]Register, 0)
+	for r := R1; r <= R31; r++ {
+		for _, m := range t.History {
+			if m[r] != int(r) {
+				registers = append(registers, Register(r))
+				break
+			}
+		}
+	}
+
+	result := new(bytes.Buffer)
+	print := spacingHelper(6, result)
+	print("")
+	for _, r := range registers {
+		print("%s", r)
+	}
+	result.WriteString("free\n")
+	for n, m := range t.History {
+		print("c#%d", n+1)
+		for _, r := range registers {
+			print("P%d", m[r])
+		}
+		fmt.Fprintf(result, "%d\n", t.Free[n])
+	}
+	return string(result.Bytes())
+}
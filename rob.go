@@ -0,0 +1,62 @@
+package mips
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ReorderBuffer holds the issued instructions in program order until they
+// commit, so that results reach the register file and memory in order and
+// instructions after a mispredicted branch can be squashed
+type ReorderBuffer struct {
+	Size      int
+	Entries   []*ROBEntry // oldest first
+	Occupancy []int       // entries in use at the end of each cycle, from cycle 1
+}
+
+// ROBEntry is an instruction waiting to commit
+type ROBEntry struct {
+	Instruction *ExecutedInstruction
+	err         error // raised when the instruction commits
+}
+
+// NewReorderBuffer returns a reorder buffer of size entries
+func NewReorderBuffer(size int) *ReorderBuffer {
+	return &ReorderBuffer{Size: size}
+}
+
+func (r *ReorderBuffer) Full() bool {
+	return len(r.Entries) >= r.Size
+}
+
+func (r *ReorderBuffer) entry(i *ExecutedInstruction) *ROBEntry {
+	for _, e := range r.Entries {
+		if e.Instruction == i {
+			return e
+		}
+	}
+	return nil
+}
+
+// String renders the entries, oldest first, with a * for those that have
+// written their result
+func (r *ReorderBuffer) String() string {
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "ROB[%d/%d", len(r.Entries), r.Size)
+	for _, e := range r.Entries {
+		fmt.Fprintf(result, " I#%d", e.Instruction.Index+1)
+		if _, ok := e.Instruction.Stages["WR"]; ok {
+			result.WriteString("*")
+		}
+	}
+	return string(result.Bytes()) + "]"
+}
+
+// RenderOccupancy renders the entries in use in each cycle as a bar chart
+func (r *ReorderBuffer) RenderOccupancy() string {
+	result := new(bytes.Buffer)
+	for n, occupancy := range r.Occupancy {
+		fmt.Fprintf(result, "c#%-4d %2d/%d %s\n", n+1, occupancy, r.Size, bytes.Repeat([]byte("#"), occupancy))
+	}
+	return string(result.Bytes())
+}
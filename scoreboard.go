@@ -0,0 +1,383 @@
+package mips
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DefaultScoreboardUnits are the functional units of each class of the
+// scoreboard: the integer unit (EX), which also executes loads, stores and
+// branches, the FP adder (A), the multipliers (M) and the divider (DIV)
+var DefaultScoreboardUnits = map[string]int{
+	"EX":  1,
+	"A":   1,
+	"M":   2,
+	"DIV": 1,
+}
+
+// ScoreboardUnit is the status of a functional unit, busy with one
+// instruction from issue until it has written its result
+type ScoreboardUnit struct {
+	Name        string
+	Class       string
+	Instruction *ExecutedInstruction // nil when free
+	Operands    []ScoreboardOperand
+	read        bool // operands read, executing
+	remaining   int  // execution cycles left
+}
+
+// ScoreboardOperand is a source register and the unit that will produce
+// it, nil once it is available in the register file
+type ScoreboardOperand struct {
+	Register Register
+	Producer *ScoreboardUnit
+	producer *ExecutedInstruction // the last producer, for the stalls
+	written  int                  // cycle the producer wrote, read the cycle after
+}
+
+func (u *ScoreboardUnit) Busy() bool {
+	return u.Instruction != nil
+}
+
+// waiting returns an operand that can not be read in cycle
+func (u *ScoreboardUnit) waiting(cycle int) *ScoreboardOperand {
+	for n, o := range u.Operands {
+		if o.Producer != nil || o.written == cycle {
+			return &u.Operands[n]
+		}
+	}
+	return nil
+}
+
+func (u *ScoreboardUnit) String() string {
+	if u.Instruction == nil {
+		return u.Name + "[]"
+	}
+	result := fmt.Sprintf("%s[I#%d %s", u.Name, u.Instruction.Index+1, u.Instruction.OpCode())
+	for _, o := range u.Operands {
+		switch {
+		case u.read:
+			result += fmt.Sprintf(" %s:read", o.Register)
+		case o.Producer != nil:
+			result += fmt.Sprintf(" %s:%s", o.Register, o.Producer.Name)
+		default:
+			result += fmt.Sprintf(" %s:ready", o.Register)
+		}
+	}
+	return result + "]"
+}
+
+// Scoreboard executes out of order with a CDC 6600 style scoreboard. An
+// instruction issues in order when its functional unit is free and no
+// earlier instruction is to write its destination (WAW), reads its
+// operands once they have been written, executes for the latency of its
+// unit and writes its result once no earlier instruction still has to
+// read the old value (WAR). There is no forwarding: operands are read from
+// the register file. Issue waits for branches to read their operands.
+type Scoreboard struct {
+	cpu    *CPU
+	Units  []*ScoreboardUnit
+	Status map[Register]*ScoreboardUnit // the unit that will write each register
+	next   *ExecutedInstruction         // fetched, waiting to issue
+	branch *ExecutedInstruction         // issue waits for the branch to resolve
+}
+
+// NewScoreboard creates the engine with the given number of functional
+// units per class, as in DefaultScoreboardUnits for the classes not given
+func NewScoreboard(cpu *CPU, units map[string]int) *Scoreboard {
+	units = mergeCounts(DefaultScoreboardUnits, units)
+	s := &Scoreboard{cpu: cpu, Status: make(map[Register]*ScoreboardUnit)}
+	for _, class := range []string{"EX", "A", "M", "DIV"} {
+		for n := 1; n <= units[class]; n++ {
+			s.Units = append(s.Units, &ScoreboardUnit{Name: fmt.Sprintf("%s%d", class, n), Class: class})
+		}
+	}
+	return s
+}
+
+func (s *Scoreboard) Step() error {
+	cpu := s.cpu
+	if cpu.InstructionCacheEmpty() && s.next == nil && s.busy() == false {
+		return CPUFinished
+	}
+	cpu.Cycle += 1
+
+	// later steps first, an instruction moves one step per cycle
+	if err := s.writeResult(); err != nil {
+		return err
+	}
+	s.execute()
+	if err := s.readOperands(); err != nil {
+		return err
+	}
+	s.issue()
+	return nil
+}
+
+func (s *Scoreboard) busy() bool {
+	for _, u := range s.Units {
+		if u.Busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// issue fetches the next instruction and moves it into a free unit of its
+// class, unless another instruction is to write its destination
+func (s *Scoreboard) issue() {
+	cpu := s.cpu
+	if s.branch != nil {
+		if read, ok := s.branch.Stages["RO"]; ok == false || read == cpu.Cycle {
+			return
+		}
+		s.branch = nil
+	}
+	if s.next == nil {
+		if cpu.InstructionCacheEmpty() {
+			return
+		}
+		s.next = &ExecutedInstruction{
+			Instruction: copyInstruction(cpu.InstructionCache[cpu.InstructionPointer]),
+			Index:       len(cpu.Instructions),
+			Stages:      make(map[string]int),
+			Cycles:      make(map[int]string),
+			Stalls:      make(map[int]*Hazard),
+			CycleStart:  cpu.Cycle,
+			CycleFinish: -1,
+			CycleFlush:  -1,
+		}
+		cpu.Instructions = append(cpu.Instructions, s.next)
+		cpu.InstructionPointer += 1
+	}
+	i := s.next
+
+	var unit, holding *ScoreboardUnit
+	for _, u := range s.Units {
+		if u.Class != i.Unit() {
+			continue
+		}
+		if u.Busy() == false {
+			unit = u
+			break
+		}
+		if holding == nil || u.Instruction.Index < holding.Instruction.Index {
+			holding = u
+		}
+	}
+	if unit == nil {
+		i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardStructural, Instruction: i, Unit: i.Unit(), Producer: holding.Instruction, Stage: "IS", Cycle: cpu.Cycle}
+		return
+	}
+	for _, r := range i.Writes() {
+		if producer, ok := s.Status[r]; ok {
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardWAW, Instruction: i, Register: r, Producer: producer.Instruction, Stage: "IS", Cycle: cpu.Cycle}
+			return
+		}
+	}
+
+	s.next = nil
+	recordStage(i, "IS", cpu.Cycle)
+	if _, ok := i.Instruction.(brancher); ok {
+		// the next instruction is known once the branch has read its operands
+		i.IF1()
+		s.branch = i
+	}
+	unit.Instruction, unit.read, unit.remaining = i, false, 0
+	unit.Operands = nil
+	for _, r := range Reads(i) {
+		o := ScoreboardOperand{Register: r, Producer: s.Status[r]}
+		if o.Producer != nil {
+			o.producer = o.Producer.Instruction
+		}
+		unit.Operands = append(unit.Operands, o)
+	}
+	// writes to R0 are dropped, R0 is never busy
+	for _, r := range i.Writes() {
+		if r != R0 {
+			s.Status[r] = unit
+		}
+	}
+}
+
+// readOperands reads the operands of the units whose producers have all
+// written and runs the instruction's hooks with them, the results are
+// written once the unit has spent its latency executing
+func (s *Scoreboard) readOperands() error {
+	cpu := s.cpu
+	for _, u := range s.unitsByAge() {
+		i := u.Instruction
+		if u.read || i.Stages["IS"] == cpu.Cycle {
+			continue
+		}
+		if o := u.waiting(cpu.Cycle); o != nil {
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardRAW, Instruction: i, Register: o.Register, Producer: o.producer, Stage: "RO", Cycle: cpu.Cycle}
+			continue
+		}
+		if producer := s.ordered(u); producer != nil {
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardStructural, Instruction: i, Unit: "MEM", Producer: producer, Stage: "RO", Cycle: cpu.Cycle}
+			continue
+		}
+
+		cpu.operands = make(map[Register]Word)
+		for _, o := range u.Operands {
+			cpu.operands[o.Register] = cpu.Registers.Get(o.Register)
+		}
+		for _, hook := range []func() error{i.ID, i.Resolve, i.EX, i.MEM1, i.MEM2, i.MEM3} {
+			if err := hook(); err != nil && err != FlushPipeline && err != BranchResolving {
+				cpu.operands = nil
+				return executionError(err, i, "RO", cpu.Cycle)
+			}
+		}
+		cpu.operands = nil
+		u.read, u.remaining = true, cpu.Unit(i.Unit()).Latency
+		recordStage(i, "RO", cpu.Cycle)
+	}
+	return nil
+}
+
+// ordered returns the earlier memory access a load or store has to wait
+// for: loads read memory when they read their operands and stores write it
+// with their result, so loads wait for earlier stores to write and stores
+// for earlier loads to read and earlier stores to write
+func (s *Scoreboard) ordered(u *ScoreboardUnit) *ExecutedInstruction {
+	a, ok := u.Instruction.Instruction.(accessor)
+	if ok == false {
+		return nil
+	}
+	_, store := a.accesses()
+	for _, o := range s.unitsByAge() {
+		if o.Instruction.Index >= u.Instruction.Index {
+			break
+		}
+		if b, ok := o.Instruction.Instruction.(accessor); ok {
+			if _, writes := b.accesses(); writes > 0 || (store > 0 && o.read == false) {
+				return o.Instruction
+			}
+		}
+	}
+	return nil
+}
+
+// execute advances the units that have read their operands
+func (s *Scoreboard) execute() {
+	cpu := s.cpu
+	for _, u := range s.Units {
+		if u.Busy() == false || u.read == false || u.remaining == 0 || u.Instruction.Stages["RO"] == cpu.Cycle {
+			continue
+		}
+		u.remaining -= 1
+		recordStage(u.Instruction, "EX", cpu.Cycle)
+	}
+}
+
+// writeResult writes the results of the units that have completed
+// execution, unless an earlier instruction has yet to read the old value
+// of a destination
+func (s *Scoreboard) writeResult() error {
+	cpu := s.cpu
+	for _, u := range s.unitsByAge() {
+		i := u.Instruction
+		if u.read == false || u.remaining > 0 || i.Stages["EX"] == cpu.Cycle {
+			continue
+		}
+		if reader, r := s.war(u); reader != nil {
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardWAR, Instruction: i, Register: r, Producer: reader, Stage: "WR", Cycle: cpu.Cycle}
+			continue
+		}
+		if err := i.WB(); err != nil {
+			return executionError(err, i, "WR", cpu.Cycle)
+		}
+		for _, r := range i.Writes() {
+			if s.Status[r] == u {
+				delete(s.Status, r)
+			}
+		}
+		for _, waiting := range s.Units {
+			for n, o := range waiting.Operands {
+				if o.Producer == u {
+					waiting.Operands[n].Producer, waiting.Operands[n].written = nil, cpu.Cycle
+				}
+			}
+		}
+		recordStage(i, "WR", cpu.Cycle)
+		i.CycleFinish = cpu.Cycle
+		u.Instruction = nil
+	}
+	return nil
+}
+
+// war returns an earlier instruction that has not read the old value of a
+// register the unit writes, and the register
+func (s *Scoreboard) war(u *ScoreboardUnit) (*ExecutedInstruction, Register) {
+	for _, r := range u.Instruction.Writes() {
+		if r == R0 {
+			continue
+		}
+		for _, o := range s.Units {
+			if o.Busy() == false || o.read || o.Instruction.Index > u.Instruction.Index {
+				continue
+			}
+			for _, operand := range o.Operands {
+				if operand.Register == r && operand.Producer != u {
+					return o.Instruction, r
+				}
+			}
+		}
+	}
+	return nil, 0
+}
+
+// unitsByAge returns the busy units, oldest instruction first
+func (s *Scoreboard) unitsByAge() []*ScoreboardUnit {
+	result := make([]*ScoreboardUnit, 0)
+	for _, u := range s.Units {
+		if u.Busy() == false {
+			continue
+		}
+		n := len(result)
+		for n > 0 && result[n-1].Instruction.Index > u.Instruction.Index {
+			n--
+		}
+		result = append(result, nil)
+		copy(result[n+1:], result[n:])
+		result[n] = u
+	}
+	return result
+}
+
+// String renders the functional unit status and the register result status
+func (s *Scoreboard) String() string {
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "c#%d", s.cpu.Cycle)
+	for _, u := range s.unitsByAge() {
+		fmt.Fprintf(result, " %s", u)
+	}
+	for r := Register(R0); r <= FCC; r++ {
+		if u, ok := s.Status[r]; ok {
+			fmt.Fprintf(result, " %s:%s", r, u.Name)
+		}
+	}
+	result.WriteString("\n")
+	return string(result.Bytes())
+}
+
+// RenderTable renders the classic instruction status table: the cycles in
+// which each instruction issued, read its operands, completed execution and
+// wrote its result
+func (s *Scoreboard) RenderTable() string {
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "%-28s %-6s %-6s %-6s %-6s\n", "Instruction", "Issue", "Read", "Exec", "Write")
+	for _, i := range s.cpu.Instructions {
+		fmt.Fprintf(result, "%-28s", fmt.Sprintf("I#%d %s", i.Index+1, i.Instruction))
+		for _, stage := range []string{"IS", "RO", "EX", "WR"} {
+			cell := ""
+			if cycle, ok := i.Stages[stage]; ok {
+				cell = fmt.Sprint(cycle)
+			}
+			fmt.Fprintf(result, " %-6s", cell)
+		}
+		result.WriteString("\n")
+	}
+	return string(result.Bytes())
+}
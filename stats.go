@@ -0,0 +1,144 @@
+package mips
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Stats summarises a run, e.g. to compare branch policies
+type Stats struct {
+	Cycles       int            `json:"cycles"`
+	Fetched      int            `json:"fetched"`
+	Committed    int            `json:"committed"` // written back, not flushed
+	Flushed      int            `json:"flushed"`
+	CPI          float64        `json:"cpi"`
+	StallCycles  int            `json:"stall_cycles"`   // cycles in which an instruction stalled
+	StallsByKind map[string]int `json:"stalls_by_kind"` // the same cycles by the cause of the oldest stall
+	Branches     int            `json:"branches"`       // committed branches and jumps
+	Taken        int            `json:"taken"`
+	Mispredicted int            `json:"mispredicted"`   // predicted branches that turned out wrong
+	Accuracy     *float64       `json:"accuracy"`       // of the predicted branches, nil (n/a) under BranchPolicyFlush
+	BranchFlush  int            `json:"branch_flushes"` // branches that flushed the pipeline when resolved
+	BTBHits      int            `json:"btb_hits"`
+	BTBMisses    int            `json:"btb_misses"` // branches predicted not taken for want of a target
+	RASHits      int            `json:"ras_hits"`
+	RASMisses    int            `json:"ras_misses"` // returns to another address, or with the stack empty
+	MemoryReads  int            `json:"memory_reads"`
+	MemoryWrites int            `json:"memory_writes"`
+}
+
+// brancher is implemented by branches and jumps
+type brancher interface {
+	outcome() (taken, predicted, flushed bool)
+}
+
+// accessor is implemented by loads and stores
+type accessor interface {
+	accesses() (reads, writes int)
+}
+
+// Stats computes the statistics of the instructions executed so far
+func (cpu *CPU) Stats() *Stats {
+	s := &Stats{
+		Cycles:       cpu.Cycle,
+		Fetched:      len(cpu.Instructions),
+		StallsByKind: make(map[string]int),
+	}
+	predicted := 0
+	for _, i := range cpu.Instructions {
+		if i.CycleFlush != -1 {
+			s.Flushed++
+			continue
+		}
+		if i.CycleFinish == -1 {
+			continue
+		}
+		s.Committed++
+		if b, ok := i.Instruction.(brancher); ok {
+			taken, wasPredicted, flushed := b.outcome()
+			s.Branches++
+			if taken {
+				s.Taken++
+			}
+			if wasPredicted {
+				predicted++
+			}
+			if wasPredicted && flushed {
+				s.Mispredicted++
+			}
+			if flushed {
+				s.BranchFlush++
+			}
+		}
+		if a, ok := i.Instruction.(accessor); ok {
+			reads, writes := a.accesses()
+			s.MemoryReads += reads
+			s.MemoryWrites += writes
+		}
+	}
+	// flushed instructions are not counted, they are shown as (fl)
+	for cycle := 1; cycle <= cpu.Cycle; cycle++ {
+		for _, i := range cpu.Instructions {
+			if cause, ok := i.Stalls[cycle]; ok && i.CycleFlush == -1 {
+				s.StallCycles++
+				s.StallsByKind[cause.Kind.String()]++
+				break
+			}
+		}
+	}
+	if cpu.BTB != nil {
+		s.BTBHits, s.BTBMisses = cpu.BTB.Hits, cpu.BTB.Misses
+	}
+	if cpu.RAS != nil {
+		s.RASHits, s.RASMisses = cpu.RAS.Hits, cpu.RAS.Misses
+	}
+	if s.Committed > 0 {
+		s.CPI = float64(s.Cycles) / float64(s.Committed)
+	}
+	if predicted > 0 {
+		accuracy := float64(predicted-s.Mispredicted) / float64(predicted)
+		s.Accuracy = &accuracy
+	}
+	return s
+}
+
+func (s *Stats) String() string {
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "Cycles:              %d\n", s.Cycles)
+	fmt.Fprintf(result, "Instructions:        %d committed, %d fetched, %d flushed\n", s.Committed, s.Fetched, s.Flushed)
+	fmt.Fprintf(result, "CPI:                 %.2f\n", s.CPI)
+	fmt.Fprintf(result, "Stall cycles:        %d\n", s.StallCycles)
+	kinds := make([]string, 0, len(s.StallsByKind))
+	for kind := range s.StallsByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(result, "  %-18s %d\n", kind+":", s.StallsByKind[kind])
+	}
+	fmt.Fprintf(result, "Branches:            %d, %d taken, %d mispredicted, %d flushed\n", s.Branches, s.Taken, s.Mispredicted, s.BranchFlush)
+	if s.Accuracy != nil {
+		fmt.Fprintf(result, "Prediction accuracy: %.1f%%\n", 100*(*s.Accuracy))
+	} else {
+		fmt.Fprintf(result, "Prediction accuracy: n/a\n")
+	}
+	if s.BTBHits+s.BTBMisses > 0 {
+		fmt.Fprintf(result, "BTB:                 %d hits, %d misses\n", s.BTBHits, s.BTBMisses)
+	}
+	if s.RASHits+s.RASMisses > 0 {
+		fmt.Fprintf(result, "RAS:                 %d hits, %d misses\n", s.RASHits, s.RASMisses)
+	}
+	fmt.Fprintf(result, "Memory:              %d reads, %d writes\n", s.MemoryReads, s.MemoryWrites)
+	return string(result.Bytes())
+}
+
+// JSON renders the statistics as indented JSON
+func (s *Stats) JSON() (string, error) {
+	result, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(result) + "\n", nil
+}
@@ -0,0 +1,542 @@
+package mips
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Engine executes the program of a CPU in place of the pipeline, one cycle
+// per Step. Instructions keep their semantics, the engine decides when each
+// hook runs and records the cycles in the executed instructions.
+type Engine interface {
+	Step() error // CPUFinished once the program has completed
+	String() string
+}
+
+// Reservation station classes besides the functional units
+const (
+	StationLoad  = "Load"
+	StationStore = "Store"
+)
+
+// DefaultStations are the reservation stations of each class: the integer
+// unit (EX), the FP adder (A), the multiplier (M), the divider (DIV) and the
+// load and store buffers
+var DefaultStations = map[string]int{
+	"EX":         3,
+	"A":          3,
+	"M":          2,
+	"DIV":        1,
+	StationLoad:  3,
+	StationStore: 3,
+}
+
+// loads take a cycle to compute the address and another to read memory
+const loadLatency = 2
+
+// ReservationStation holds an issued instruction until it has executed and
+// written its result on the common data bus
+type ReservationStation struct {
+	Name        string
+	Class       string
+	Instruction *ExecutedInstruction // nil when free
+	Operands    []StationOperand
+	remaining   int // execution cycles left, -1 until started
+	executed    int // cycle execution completed
+}
+
+// StationOperand is a source register, either its value or the tag of the
+// instruction that will produce it
+type StationOperand struct {
+	Register Register
+	Value    Word
+	Tag      *ExecutedInstruction
+}
+
+func (s *ReservationStation) Busy() bool {
+	return s.Instruction != nil
+}
+
+func (s *ReservationStation) ready() bool {
+	for _, o := range s.Operands {
+		if o.Tag != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *ReservationStation) String() string {
+	if s.Instruction == nil {
+		return s.Name + "[]"
+	}
+	result := fmt.Sprintf("%s[I#%d %s", s.Name, s.Instruction.Index+1, s.Instruction.OpCode())
+	for _, o := range s.Operands {
+		if o.Tag != nil {
+			result += fmt.Sprintf(" %s=I#%d", o.Register, o.Tag.Index+1)
+		} else {
+			result += fmt.Sprintf(" %s=%d", o.Register, o.Value)
+		}
+	}
+	return result + "]"
+}
+
+// Tomasulo executes out of order with Tomasulo's algorithm. Instructions
+// issue in order into reservation stations, renaming their destinations to
+// the tag of the issuing instruction, execute once their operands are on
+// hand and write their results on a common data bus, one per cycle.
+//
+// Without a reorder buffer issue waits for branches to resolve, loads for
+// earlier stores to write and stores for all earlier memory accesses. With
+// one, issue follows the predicted path and instructions commit in order,
+// those after a mispredicted branch are squashed when it commits.
+type Tomasulo struct {
+	cpu      *CPU
+	Stations []*ReservationStation
+	Status   map[Register]*ExecutedInstruction // the instruction each register waits for
+	ROB      *ReorderBuffer                    // nil without speculation
+	branch   *ExecutedInstruction              // issue waits for the branch to resolve
+}
+
+// NewTomasulo creates the engine with the given number of reservation
+// stations per class, as in DefaultStations for the classes not given, and
+// a reorder buffer of robSize entries unless 0
+func NewTomasulo(cpu *CPU, stations map[string]int, robSize int) *Tomasulo {
+	stations = mergeCounts(DefaultStations, stations)
+	t := &Tomasulo{cpu: cpu, Status: make(map[Register]*ExecutedInstruction)}
+	if robSize > 0 {
+		t.ROB = NewReorderBuffer(robSize)
+	}
+	for _, class := range []string{StationLoad, StationStore, "EX", "A", "M", "DIV"} {
+		for n := 1; n <= stations[class]; n++ {
+			t.Stations = append(t.Stations, &ReservationStation{Name: fmt.Sprintf("%s%d", class, n), Class: class})
+		}
+	}
+	return t
+}
+
+// mergeCounts returns the defaults overridden by the counts given
+func mergeCounts(defaults, counts map[string]int) map[string]int {
+	result := make(map[string]int)
+	for class, n := range defaults {
+		result[class] = n
+	}
+	for class, n := range counts {
+		result[class] = n
+	}
+	return result
+}
+
+// stationClass returns the class of reservation station an instruction
+// issues to
+func stationClass(i Instruction) string {
+	if a, ok := i.(accessor); ok {
+		if _, writes := a.accesses(); writes > 0 {
+			return StationStore
+		}
+		return StationLoad
+	}
+	return i.Unit()
+}
+
+func (t *Tomasulo) Step() error {
+	cpu := t.cpu
+	if cpu.InstructionCacheEmpty() && t.busy() == false {
+		return CPUFinished
+	}
+	cpu.Cycle += 1
+
+	if t.ROB != nil {
+		if err := t.commit(); err != nil {
+			return err
+		}
+	}
+	if err := t.execute(); err != nil {
+		return err
+	}
+	if err := t.writeResult(); err != nil {
+		return err
+	}
+	err := t.issue()
+	if t.ROB != nil {
+		t.ROB.Occupancy = append(t.ROB.Occupancy, len(t.ROB.Entries))
+	}
+	return err
+}
+
+func (t *Tomasulo) busy() bool {
+	if t.ROB != nil && len(t.ROB.Entries) > 0 {
+		return true
+	}
+	for _, s := range t.Stations {
+		if s.Busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// issue moves the next instruction into a free station of its class
+func (t *Tomasulo) issue() error {
+	cpu := t.cpu
+	if cpu.InstructionCacheEmpty() {
+		return nil
+	}
+	if t.branch != nil && t.resolved(t.branch) == false {
+		return nil
+	}
+	if t.ROB != nil && t.ROB.Full() {
+		return nil
+	}
+	instruction := copyInstruction(cpu.InstructionCache[cpu.InstructionPointer])
+	var station *ReservationStation
+	for _, s := range t.Stations {
+		if s.Class == stationClass(instruction) && s.Busy() == false {
+			station = s
+			break
+		}
+	}
+	if station == nil {
+		// structural hazard, issue waits for a station
+		return nil
+	}
+
+	i := &ExecutedInstruction{
+		Instruction: instruction,
+		Index:       len(cpu.Instructions),
+		Stages:      make(map[string]int),
+		Cycles:      make(map[int]string),
+		Stalls:      make(map[int]*Hazard),
+		CycleStart:  cpu.Cycle,
+		CycleFinish: -1,
+		CycleFlush:  -1,
+	}
+	cpu.Instructions = append(cpu.Instructions, i)
+	cpu.InstructionPointer += 1
+	recordStage(i, "IS", cpu.Cycle)
+	if t.ROB != nil {
+		t.ROB.Entries = append(t.ROB.Entries, &ROBEntry{Instruction: i})
+	}
+	t.branch = nil
+	if _, ok := instruction.(brancher); ok {
+		if cpu.BranchMode == BranchPolicyFlush {
+			// the next instruction is known once the branch has resolved
+			instruction.IF1()
+			t.branch = i
+		} else {
+			// predict, fetch goes on along the predicted path
+			instruction.IF1()
+			if err := instruction.IF2(); err != nil && err != FlushPipeline {
+				return err
+			}
+		}
+	}
+
+	station.Instruction, station.remaining, station.executed = i, -1, 0
+	station.Operands = nil
+	for _, r := range Reads(i) {
+		o := StationOperand{Register: r, Tag: t.Status[r]}
+		switch {
+		case o.Tag == nil:
+			o.Value = cpu.Registers.Get(r)
+		case written(o.Tag):
+			// waiting in the reorder buffer to commit
+			o.Value, _ = o.Tag.Result(r)
+			o.Tag = nil
+		}
+		station.Operands = append(station.Operands, o)
+	}
+	// rename the destinations, writes to R0 are dropped
+	for _, r := range i.Writes() {
+		if r != R0 {
+			t.Status[r] = i
+		}
+	}
+	return nil
+}
+
+// resolved reports whether issue may go on past a branch, once it has
+// executed, or with a reorder buffer once it has committed
+func (t *Tomasulo) resolved(branch *ExecutedInstruction) bool {
+	if t.ROB != nil {
+		return branch.CycleFinish != -1
+	}
+	executed, ok := branch.Stages["EX"]
+	return ok && executed < t.cpu.Cycle
+}
+
+func written(i *ExecutedInstruction) bool {
+	_, ok := i.Stages["WR"]
+	return ok
+}
+
+// execute starts the stations whose operands are on hand and advances
+// those executing. Pipelined units start one instruction per cycle,
+// unpipelined ones wait until the previous has finished.
+func (t *Tomasulo) execute() error {
+	cpu := t.cpu
+	// units that can not start another instruction this cycle
+	busy := make(map[string]bool)
+	for _, s := range t.Stations {
+		if s.Busy() && s.remaining > 0 && cpu.Unit(s.Instruction.Unit()).Pipelined == false {
+			busy[s.Instruction.Unit()] = true
+		}
+	}
+
+	for _, s := range t.stationsByAge() {
+		i := s.Instruction
+		switch {
+		case s.remaining > 0:
+			s.remaining -= 1
+		case s.remaining == 0:
+			// executed, waiting to write its result
+			continue
+		case s.ready() == false:
+			for _, o := range s.Operands {
+				if o.Tag != nil {
+					i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardRAW, Instruction: i, Register: o.Register, Producer: o.Tag, Stage: s.Name, Cycle: cpu.Cycle}
+					break
+				}
+			}
+			continue
+		case s.Class != StationLoad && s.Class != StationStore && busy[i.Unit()]:
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardStructural, Instruction: i, Unit: i.Unit(), Stage: s.Name, Cycle: cpu.Cycle}
+			continue
+		case t.ordered(s) == false:
+			i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardStructural, Instruction: i, Unit: "MEM", Stage: s.Name, Cycle: cpu.Cycle}
+			continue
+		default:
+			if err := t.start(s); err != nil {
+				err = executionError(err, i, "EX", cpu.Cycle)
+				if t.ROB == nil {
+					return err
+				}
+				// raised if the instruction commits
+				t.ROB.entry(i).err = err
+			}
+			if s.Class != StationLoad && s.Class != StationStore {
+				busy[i.Unit()] = true
+			}
+		}
+		recordStage(i, "EX", cpu.Cycle)
+		if s.remaining == 0 {
+			s.executed = cpu.Cycle
+		}
+	}
+	return nil
+}
+
+// start runs the instruction's hooks with its operands, the results are
+// written when it has spent the latency of its unit executing. With a
+// reorder buffer branches are resolved when they commit.
+func (t *Tomasulo) start(s *ReservationStation) error {
+	cpu := t.cpu
+	i := s.Instruction
+	cpu.operands = make(map[Register]Word)
+	for _, o := range s.Operands {
+		cpu.operands[o.Register] = o.Value
+	}
+	defer func() { cpu.operands = nil }()
+
+	switch s.Class {
+	case StationLoad:
+		s.remaining = loadLatency - 1
+	case StationStore:
+		s.remaining = 0
+	default:
+		s.remaining = cpu.Unit(i.Unit()).Latency - 1
+	}
+	hooks := []func() error{i.ID, i.Resolve, i.EX, i.MEM1, i.MEM2, i.MEM3}
+	if t.ROB != nil {
+		hooks = []func() error{i.ID, i.EX, i.MEM1, i.MEM2, i.MEM3}
+	}
+	for _, hook := range hooks {
+		if err := hook(); err != nil && err != FlushPipeline && err != BranchResolving {
+			return err
+		}
+	}
+	return nil
+}
+
+// ordered reports whether a memory access may start: no earlier store may
+// be waiting to write, and a store also waits for earlier loads. With a
+// reorder buffer stores write when they commit, so only loads wait for the
+// earlier stores to commit.
+func (t *Tomasulo) ordered(s *ReservationStation) bool {
+	if s.Class != StationLoad && s.Class != StationStore {
+		return true
+	}
+	if t.ROB != nil {
+		for _, e := range t.ROB.Entries {
+			if e.Instruction == s.Instruction {
+				break
+			}
+			if s.Class == StationLoad && stationClass(e.Instruction.Instruction) == StationStore {
+				return false
+			}
+		}
+		return true
+	}
+	for _, o := range t.Stations {
+		if o.Busy() == false || o.Instruction.Index >= s.Instruction.Index {
+			continue
+		}
+		if o.Class == StationStore || (s.Class == StationStore && o.Class == StationLoad && o.remaining < 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeResult puts the result of the oldest executed instruction on the
+// common data bus, to the stations waiting for it and the register file, or
+// with a reorder buffer to the instruction's entry. Stores and instructions
+// without results finish without the bus.
+func (t *Tomasulo) writeResult() error {
+	cpu := t.cpu
+	bus := false
+	for _, s := range t.stationsByAge() {
+		if s.remaining != 0 || s.executed == cpu.Cycle {
+			continue
+		}
+		i := s.Instruction
+		writes := i.Writes()
+		if len(writes) > 0 {
+			if bus {
+				i.Stalls[cpu.Cycle] = &Hazard{Kind: HazardStructural, Instruction: i, Unit: "CDB", Stage: s.Name, Cycle: cpu.Cycle}
+				continue
+			}
+			bus = true
+		}
+		if s.Class == StationStore && t.ROB == nil {
+			if err := i.WB(); err != nil {
+				return executionError(err, i, "WR", cpu.Cycle)
+			}
+		}
+		for _, r := range writes {
+			value, _ := i.Result(r)
+			if t.Status[r] == i && t.ROB == nil {
+				if err := cpu.writeRegister(r, value); err != nil {
+					return err
+				}
+				delete(t.Status, r)
+			}
+			for _, waiting := range t.Stations {
+				for n, o := range waiting.Operands {
+					if o.Tag == i && o.Register == r {
+						waiting.Operands[n] = StationOperand{Register: r, Value: value}
+					}
+				}
+			}
+		}
+		recordStage(i, "WR", cpu.Cycle)
+		if t.ROB == nil {
+			i.CycleFinish = cpu.Cycle
+		}
+		s.Instruction = nil
+	}
+	return nil
+}
+
+// commit retires the oldest instruction once its result has been written,
+// writing the register file and memory. A mispredicted branch redirects
+// fetch and squashes the instructions after it, an instruction that faulted
+// raises its error.
+func (t *Tomasulo) commit() error {
+	cpu := t.cpu
+	if len(t.ROB.Entries) == 0 {
+		return nil
+	}
+	e := t.ROB.Entries[0]
+	i := e.Instruction
+	if written, ok := i.Stages["WR"]; ok == false || written == cpu.Cycle {
+		return nil
+	}
+	if e.err != nil {
+		return e.err
+	}
+	t.ROB.Entries = t.ROB.Entries[1:]
+	recordStage(i, "CM", cpu.Cycle)
+	i.CycleFinish = cpu.Cycle
+
+	if stationClass(i.Instruction) == StationStore {
+		if err := i.WB(); err != nil {
+			return executionError(err, i, "CM", cpu.Cycle)
+		}
+	}
+	for _, r := range i.Writes() {
+		value, _ := i.Result(r)
+		if err := cpu.writeRegister(r, value); err != nil {
+			return err
+		}
+		if t.Status[r] == i {
+			delete(t.Status, r)
+		}
+	}
+	if _, ok := i.Instruction.(brancher); ok {
+		if err := i.Resolve(); err == FlushPipeline {
+			t.squash()
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// squash discards the instructions in the reorder buffer, fetched after a
+// mispredicted branch. Resolving the branch has restored the return address
+// stack.
+func (t *Tomasulo) squash() {
+	cpu := t.cpu
+	for _, e := range t.ROB.Entries {
+		e.Instruction.CycleFlush = cpu.Cycle
+		e.Instruction.CycleFinish = cpu.Cycle
+		for _, s := range t.Stations {
+			if s.Instruction == e.Instruction {
+				s.Instruction = nil
+			}
+		}
+	}
+	t.ROB.Entries = nil
+	// the register file holds every committed value
+	t.Status = make(map[Register]*ExecutedInstruction)
+	t.branch = nil
+}
+
+// stationsByAge returns the busy stations, oldest instruction first
+func (t *Tomasulo) stationsByAge() []*ReservationStation {
+	result := make([]*ReservationStation, 0)
+	for _, s := range t.Stations {
+		if s.Busy() == false {
+			continue
+		}
+		n := len(result)
+		for n > 0 && result[n-1].Instruction.Index > s.Instruction.Index {
+			n--
+		}
+		result = append(result, nil)
+		copy(result[n+1:], result[n:])
+		result[n] = s
+	}
+	return result
+}
+
+// String renders the busy reservation stations, the register status and
+// the reorder buffer
+func (t *Tomasulo) String() string {
+	result := new(bytes.Buffer)
+	fmt.Fprintf(result, "c#%d", t.cpu.Cycle)
+	for _, s := range t.stationsByAge() {
+		fmt.Fprintf(result, " %s", s)
+	}
+	for r := Register(R0); r <= FCC; r++ {
+		if i, ok := t.Status[r]; ok {
+			fmt.Fprintf(result, " %s:I#%d", r, i.Index+1)
+		}
+	}
+	if t.ROB != nil {
+		fmt.Fprintf(result, " %s", t.ROB)
+	}
+	result.WriteString("\n")
+	return string(result.Bytes())
+}
@@ -0,0 +1,223 @@
+package mips
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Default functional unit latencies, in cycles
+const (
+	DefaultFPAddLatency    = 4
+	DefaultMultiplyLatency = 7
+	DefaultDivideLatency   = 24
+)
+
+// FunctionalUnit is an execution unit that the EX stage dispatches
+// instructions to. A pipelined unit accepts a new instruction every cycle,
+// or Width of them for a superscalar pipeline, an unpipelined unit only
+// once the previous instruction has left it.
+type FunctionalUnit struct {
+	Name      string // shown in timing output, numbered for pipelined units (M1..M7)
+	Latency   int
+	Pipelined bool
+	Width     int          // instructions in each stage of the unit, 1 if 0
+	entries   []*unitEntry // oldest first
+}
+
+type unitEntry struct {
+	instruction *ExecutedInstruction
+	position    int // current stage within the unit, 1..Latency
+}
+
+func NewFunctionalUnit(name string, latency int, pipelined bool) *FunctionalUnit {
+	return &FunctionalUnit{
+		Name:      name,
+		Latency:   latency,
+		Pipelined: pipelined,
+	}
+}
+
+// the default units: a single cycle integer ALU, a pipelined FP adder, a
+// pipelined FP/integer multiplier and an unpipelined FP/integer divider
+func defaultFunctionalUnits() []*FunctionalUnit {
+	return []*FunctionalUnit{
+		NewFunctionalUnit("EX", 1, true),
+		NewFunctionalUnit("A", DefaultFPAddLatency, true),
+		NewFunctionalUnit("M", DefaultMultiplyLatency, true),
+		NewFunctionalUnit("DIV", DefaultDivideLatency, false),
+	}
+}
+
+func (u *FunctionalUnit) String() string {
+	return u.Name
+}
+
+func (u *FunctionalUnit) stageName(position int) string {
+	if u.Pipelined && u.Latency > 1 {
+		return fmt.Sprintf("%s%d", u.Name, position)
+	}
+	return u.Name
+}
+
+// Busy reports whether any instruction is in the unit
+func (u *FunctionalUnit) Busy() bool {
+	return len(u.entries) > 0
+}
+
+// Instructions returns the instructions in the unit, oldest first
+func (u *FunctionalUnit) Instructions() []*ExecutedInstruction {
+	result := make([]*ExecutedInstruction, 0, len(u.entries))
+	for _, e := range u.entries {
+		result = append(result, e.instruction)
+	}
+	return result
+}
+
+func (u *FunctionalUnit) width() int {
+	if u.Width < 1 {
+		return 1
+	}
+	return u.Width
+}
+
+// accepts reports whether an instruction may be dispatched this cycle
+func (u *FunctionalUnit) accepts() bool {
+	if u.Pipelined == false {
+		return len(u.entries) == 0
+	}
+	dispatched := 0
+	for _, e := range u.entries {
+		if e.position == 1 {
+			dispatched++
+		}
+	}
+	return dispatched < u.width()
+}
+
+// dispatch starts an instruction in the first stage of the unit, returning
+// true if it completes in the same cycle
+func (u *FunctionalUnit) dispatch(i *ExecutedInstruction, cycle int) bool {
+	u.entries = append(u.entries, &unitEntry{instruction: i, position: 1})
+	recordStage(i, u.stageName(1), cycle)
+	return u.Latency == 1
+}
+
+// advance moves every instruction one stage further, oldest first. An
+// instruction that has finished waits in the last stage until it can leave,
+// holding up those behind it. It returns the instructions that reached the
+// last stage this cycle.
+func (u *FunctionalUnit) advance(cycle int) (completed []*ExecutedInstruction) {
+	occupied := make(map[int]int)
+	for _, e := range u.entries {
+		if e.position < u.Latency && occupied[e.position+1] < u.width() {
+			e.position += 1
+			recordStage(e.instruction, u.stageName(e.position), cycle)
+			if e.position == u.Latency {
+				completed = append(completed, e.instruction)
+			}
+		}
+		occupied[e.position]++
+	}
+	return completed
+}
+
+// finished returns the oldest instruction waiting to leave the unit
+func (u *FunctionalUnit) finished() *ExecutedInstruction {
+	if len(u.entries) > 0 && u.entries[0].position == u.Latency {
+		return u.entries[0].instruction
+	}
+	return nil
+}
+
+func (u *FunctionalUnit) remove(i *ExecutedInstruction) {
+	for n, e := range u.entries {
+		if e.instruction == i {
+			u.entries = append(u.entries[:n], u.entries[n+1:]...)
+			return
+		}
+	}
+}
+
+// writes returns an instruction in the unit that will write register r
+func (u *FunctionalUnit) writes(r Register) *ExecutedInstruction {
+	for _, e := range u.entries {
+		for _, w := range e.instruction.Writes() {
+			if w == r {
+				return e.instruction
+			}
+		}
+	}
+	return nil
+}
+
+// ahead returns the instruction keeping a finished instruction in the unit
+func (u *FunctionalUnit) ahead(i *ExecutedInstruction) *ExecutedInstruction {
+	for _, e := range u.entries {
+		if e.instruction == i {
+			break
+		}
+		if e.position == u.Latency {
+			return e.instruction
+		}
+	}
+	if ex, ok := i.Stage.(*EX); ok && len(ex.out) > 0 {
+		return ex.out[0]
+	}
+	return nil
+}
+
+// blocker returns the instruction keeping the unit from accepting another
+func (u *FunctionalUnit) blocker() *ExecutedInstruction {
+	for _, e := range u.entries {
+		if u.Pipelined == false || e.position == 1 {
+			return e.instruction
+		}
+	}
+	return nil
+}
+
+// Unit returns the functional unit with the given name, or nil
+func (cpu *CPU) Unit(name string) *FunctionalUnit {
+	for _, u := range cpu.Units {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (cpu *CPU) unitFor(i Instruction) (*FunctionalUnit, error) {
+	if u := cpu.Unit(i.Unit()); u != nil {
+		return u, nil
+	}
+	return nil, errors.New(fmt.Sprintf("No functional unit %s for %s", i.Unit(), i.OpCode()))
+}
+
+// unitPendingWrite returns an instruction still executing in a functional
+// unit that will write register r. A later instruction writing the same
+// register could otherwise finish first (WAW hazard).
+func (cpu *CPU) unitPendingWrite(r Register) *ExecutedInstruction {
+	for _, u := range cpu.Units {
+		if i := u.writes(r); i != nil {
+			return i
+		}
+	}
+	return nil
+}
+
+// unitHolding returns the functional unit an instruction is executing in
+func (cpu *CPU) unitHolding(i *ExecutedInstruction) *FunctionalUnit {
+	for _, u := range cpu.Units {
+		for _, e := range u.entries {
+			if e.instruction == i {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+func recordStage(i *ExecutedInstruction, name string, cycle int) {
+	i.Stages[name] = cycle
+	i.Cycles[cycle] = name
+}